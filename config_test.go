@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	yamlFile := filepath.Join(dir, "around.yaml")
+	os.WriteFile(yamlFile, []byte("signing_key: from-file\nport: \"9000\"\nlog_level: debug\naccess_token_ttl: 5m\ncors_origins:\n  - https://a.example\n  - https://b.example\n"), 0600)
+	jsonFile := filepath.Join(dir, "around.json")
+	os.WriteFile(jsonFile, []byte(`{"signing_key": "from-file", "max_upload_size": 1000000, "bigtable_enabled": true}`), 0600)
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		check func(c *Config) bool
+	}{
+		{"defaults", nil, []string{"-signing-key", "k"}, func(c *Config) bool {
+			return c.Port == "8080" && c.LogLevel == "info" && !c.BigtableEnabled
+		}},
+		{"file over defaults", nil, []string{"-config", yamlFile}, func(c *Config) bool {
+			return c.Port == "9000" && c.LogLevel == "debug" && c.AccessTokenTTL.Minutes() == 5 &&
+				strings.Join(c.CORSOrigins, " ") == "https://a.example https://b.example"
+		}},
+		{"json file", nil, []string{"-config", jsonFile}, func(c *Config) bool {
+			return c.MaxUploadSize == 1000000 && c.BigtableEnabled
+		}},
+		{"config path from env", map[string]string{"AROUND_CONFIG": yamlFile}, nil, func(c *Config) bool {
+			return c.Port == "9000"
+		}},
+		{"env over file", map[string]string{"AROUND_LOG_LEVEL": "warn"}, []string{"-config", yamlFile}, func(c *Config) bool {
+			return c.Port == "9000" && c.LogLevel == "warn"
+		}},
+		{"flags over env", map[string]string{"AROUND_LOG_LEVEL": "warn"}, []string{"-config", yamlFile, "-log-level", "error"}, func(c *Config) bool {
+			return c.LogLevel == "error"
+		}},
+		{"bool flag alone", nil, []string{"-signing-key", "k", "-bigtable-enabled"}, func(c *Config) bool {
+			return c.BigtableEnabled
+		}},
+		{"bool flag over env", map[string]string{"AROUND_BIGTABLE_ENABLED": "true"}, []string{"-signing-key", "k", "-bigtable-enabled=false"}, func(c *Config) bool {
+			return !c.BigtableEnabled
+		}},
+		{"tfserving_url follows ml_model", nil, []string{"-signing-key", "k", "-ml-model", "faces"}, func(c *Config) bool {
+			return c.TFServingURL == "http://localhost:8501/v1/models/faces:predict"
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, val := range tt.env {
+				t.Setenv(key, val)
+			}
+			c, err := loadConfig(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(c) {
+				t.Errorf("unexpected config: %v", c.LogValue())
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	unknown := filepath.Join(dir, "unknown.yaml")
+	os.WriteFile(unknown, []byte("signing_key: k\nes_ulr: http://es:9200\n"), 0600)
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"unknown file key", nil, []string{"-config", unknown}, `unknown key "es_ulr"`},
+		{"missing file", nil, []string{"-config", filepath.Join(dir, "missing.yaml")}, "missing.yaml"},
+		{"bad env duration", map[string]string{"AROUND_STORE_TIMEOUT": "soon"}, []string{"-signing-key", "k"}, "AROUND_STORE_TIMEOUT"},
+		{"bad flag int", nil, []string{"-signing-key", "k", "-trusted-proxies", "two"}, "-trusted-proxies"},
+		{"unknown flag", nil, []string{"-no-such-flag"}, "no-such-flag"},
+		{"invalid value", nil, []string{"-signing-key", "k", "-post-store", "mongo"}, `unknown post_store "mongo"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, val := range tt.env {
+				t.Setenv(key, val)
+			}
+			_, err := loadConfig(tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want it to mention %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   string // part of the error, empty if valid
+	}{
+		{"defaults with a key", func(c *Config) {}, ""},
+		{"no signing key", func(c *Config) { c.SigningKey = "" }, "signing_key or jwt_keys is required"},
+		{"jwt keys only", func(c *Config) { c.SigningKey, c.JWTKeys = "", []string{"k1:HS256:/keys/k1"} }, ""},
+		{"half of tls", func(c *Config) { c.TLSCertFile = "cert.pem" }, "tls_cert_file and tls_key_file go together"},
+		{"tls and autocert", func(c *Config) {
+			c.TLSCertFile, c.TLSKeyFile, c.AutocertDomains = "cert.pem", "key.pem", []string{"around.example"}
+		}, "not both"},
+		{"log level", func(c *Config) { c.LogLevel = "loud" }, `unknown log_level "loud"`},
+		{"sample ratio", func(c *Config) { c.TraceSampleRatio = 2 }, "trace_sample_ratio"},
+		{"credentials with any origin", func(c *Config) { c.CORSCredentials = true }, "cors_credentials needs explicit cors_origins"},
+		{"origin without scheme", func(c *Config) { c.CORSOrigins = []string{"around.example"} }, `cors_origins: "around.example"`},
+		{"default range over the cap", func(c *Config) { c.SearchDistance = "2000km" }, "search_distance is larger than max_search_distance"},
+		{"range unit", func(c *Config) { c.MaxSearchDistance = "far" }, "max_search_distance:"},
+		{"es_url for elasticsearch", func(c *Config) { c.ESURL = "" }, "es_url is required"},
+		{"es_url not needed for memory", func(c *Config) {
+			c.ESURL, c.PostStore, c.UserStore, c.TokenStore = "", STORE_MEMORY, STORE_MEMORY, STORE_MEMORY
+		}, ""},
+		{"es_url for users only", func(c *Config) {
+			c.ESURL, c.PostStore, c.TokenStore = "", STORE_MEMORY, STORE_MEMORY
+		}, "es_url is required"},
+		{"user store", func(c *Config) { c.UserStore = "ldap" }, `unknown user_store "ldap"`},
+		{"bucket for gcs", func(c *Config) { c.BucketName = " " }, "bucket_name is required"},
+		{"local media", func(c *Config) { c.MediaStore, c.MediaURL = MEDIA_LOCAL, "" }, "media_url is required"},
+		{"bigtable", func(c *Config) { c.BigtableEnabled, c.BigtableInstance = true, "" }, "bigtable_instance is required"},
+		{"face scorer", func(c *Config) { c.FaceScorer = "magic" }, `unknown face_scorer "magic"`},
+		{"timeouts", func(c *Config) { c.WriteTimeout = 0 }, "must be positive"},
+		{"rate", func(c *Config) { c.LoginRateIP = "lots" }, "login_rate_ip:"},
+		{"lockout", func(c *Config) { c.LoginLockoutMax = c.LoginLockout / 2 }, "login_lockout_max at least login_lockout"},
+		{"metrics on the public port", func(c *Config) { c.MetricsAddr = ":8080" }, "metrics_addr must not use port"},
+		{"metrics address", func(c *Config) { c.MetricsAddr = "9090" }, "must be host:port"},
+		{"metrics off", func(c *Config) { c.MetricsAddr = "" }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultConfig()
+			c.SigningKey = "k"
+			tt.change(c)
+			err := c.validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("validate() = %v, want nil", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("validate() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	c := defaultConfig()
+	c.ESURL, c.TokenStore = "", STORE_ELASTICSEARCH
+	if err := c.validate(); strings.Count(err.Error(), "es_url is required") != 1 {
+		t.Errorf("validate() = %v, want es_url reported once", err)
+	}
+}
+
+// logConfig renders c like the startup log line and returns its fields and the raw line
+func logConfig(t *testing.T, c *Config) (map[string]string, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	slog.New(slog.NewJSONHandler(&buf, nil)).Info("effective config", "config", c)
+	var line struct {
+		Config map[string]string `json:"config"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("log line %s: %v", buf.String(), err)
+	}
+	return line.Config, buf.String()
+}
+
+func TestConfigLogValue(t *testing.T) {
+	c := defaultConfig()
+	c.SigningKey = "hunter2"
+	c.RedisURL = "redis://:hunter2@redis:6379/0"
+	c.ESURL = "http://elastic:hunter2@es:9200"
+	fields, raw := logConfig(t, c)
+	if strings.Contains(raw, "hunter2") {
+		t.Errorf("log line leaks a secret: %s", raw)
+	}
+	for key, want := range map[string]string{"signing_key": "REDACTED", "redis_url": "REDACTED", "es_url": "REDACTED", "port": "8080", "cors_methods": "GET,POST,PUT,DELETE"} {
+		if fields[key] != want {
+			t.Errorf("%s = %q, want %q", key, fields[key], want)
+		}
+	}
+
+	c.SigningKey = ""
+	if fields, _ := logConfig(t, c); fields["signing_key"] != "" {
+		t.Error("an empty secret is shown as REDACTED, hiding that it is unset")
+	}
+}
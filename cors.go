@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const CORS_ANY_ORIGIN = "*"
+
+// withCORS answers preflight requests and adds the CORS headers to every other response of an allowed origin.
+// It wraps the whole router, so a preflight never reaches the JWT middleware and 404/405 answers are readable by the browser too.
+func withCORS(next http.Handler) http.Handler {
+	anyOrigin := false
+	allowed := map[string]bool{}
+	for _, origin := range config.CORSOrigins {
+		if origin == CORS_ANY_ORIGIN {
+			anyOrigin = true
+		}
+		allowed[strings.TrimSuffix(origin, "/")] = true
+	}
+	methods := strings.Join(config.CORSMethods, ",")
+	headers := strings.Join(config.CORSHeaders, ",")
+	maxAge := strconv.Itoa(int(config.CORSMaxAge.Seconds()))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !anyOrigin {
+			w.Header().Add("Vary", "Origin") // the answer depends on the origin, caches must not share it
+		}
+		if origin == "" { // same origin or not a browser
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !anyOrigin && !allowed[origin] {
+			if preflight {
+				writeError(w, r, ErrForbidden, "Origin is not allowed")
+				return
+			}
+			next.ServeHTTP(w, r) // without CORS headers the browser hides the response from the page
+			return
+		}
+
+		if anyOrigin { // never with credentials, validate rejects that
+			w.Header().Set("Access-Control-Allow-Origin", CORS_ANY_ORIGIN)
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if config.CORSCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", REQUEST_ID_HEADER+",Retry-After") // so the page can report and honor them
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", methods)
+		w.Header().Set("Access-Control-Allow-Headers", headers)
+		w.Header().Set("Access-Control-Max-Age", maxAge) // browsers cap this, Chrome at 2 hours
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
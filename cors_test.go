@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWithCORS(t *testing.T) {
+	setupMemory(t)
+	config.CORSOrigins = []string{"https://around.example", "http://localhost:3000/"}
+	config.CORSMaxAge = time.Hour
+
+	tests := []struct {
+		name      string
+		method    string
+		origin    string
+		preflight bool // sends Access-Control-Request-Method
+		status    int
+		allow     string // Access-Control-Allow-Origin
+		reached   bool   // the request got to the router
+	}{
+		{"same origin", "GET", "", false, http.StatusOK, "", true},
+		{"allowed origin", "GET", "https://around.example", false, http.StatusOK, "https://around.example", true},
+		{"allowed with the slash trimmed", "POST", "http://localhost:3000", false, http.StatusOK, "http://localhost:3000", true},
+		{"rejected origin", "GET", "https://evil.example", false, http.StatusOK, "", true},
+		{"preflight", "OPTIONS", "https://around.example", true, http.StatusNoContent, "https://around.example", false},
+		{"rejected preflight", "OPTIONS", "https://evil.example", true, http.StatusForbidden, "", false},
+		{"OPTIONS that is no preflight", "OPTIONS", "https://around.example", false, http.StatusOK, "https://around.example", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached := false
+			handler := withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = true }))
+			r := httptest.NewRequest(tt.method, "/search", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				r.Header.Set("Access-Control-Request-Method", "POST")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status || reached != tt.reached {
+				t.Fatalf("status = %d, reached = %v, want %d, %v", w.Code, reached, tt.status, tt.reached)
+			}
+			h := w.Header()
+			if got := h.Get("Access-Control-Allow-Origin"); got != tt.allow {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.allow)
+			}
+			if h.Get("Vary") != "Origin" {
+				t.Errorf("Vary = %q, want Origin", h.Get("Vary"))
+			}
+			if tt.preflight && tt.allow != "" {
+				if h.Get("Access-Control-Allow-Methods") != "GET,POST,PUT,DELETE" ||
+					h.Get("Access-Control-Allow-Headers") != "Content-Type,Authorization,"+REQUEST_ID_HEADER ||
+					h.Get("Access-Control-Max-Age") != "3600" {
+					t.Errorf("preflight headers = %v", h)
+				}
+			}
+			if !tt.preflight && tt.allow != "" && h.Get("Access-Control-Expose-Headers") == "" {
+				t.Error("Access-Control-Expose-Headers is missing")
+			}
+			if h.Get("Access-Control-Allow-Credentials") != "" {
+				t.Error("credentials allowed without cors_credentials")
+			}
+		})
+	}
+}
+
+func TestWithCORSAnyOrigin(t *testing.T) {
+	setupMemory(t) // default cors_origins is *
+
+	handler := withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest("OPTIONS", "/post", nil)
+	r.Header.Set("Origin", "https://anywhere.example")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != CORS_ANY_ORIGIN {
+		t.Errorf("preflight = %d %v, want 204 with origin *", w.Code, w.Header())
+	}
+	if w.Header().Get("Vary") != "" {
+		t.Errorf("Vary = %q, the answer does not depend on the origin", w.Header().Get("Vary"))
+	}
+}
+
+func TestWithCORSCredentials(t *testing.T) {
+	setupMemory(t)
+	config.CORSOrigins = []string{"https://around.example"}
+	config.CORSCredentials = true
+
+	handler := withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for origin, want := range map[string]string{"https://around.example": "true", "https://evil.example": ""} {
+		r := httptest.NewRequest("GET", "/search", nil)
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if got := w.Header().Get("Access-Control-Allow-Credentials"); got != want {
+			t.Errorf("%s: Access-Control-Allow-Credentials = %q, want %q", origin, got, want)
+		}
+	}
+}
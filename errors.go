@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Errors handlers and stores return, writeError turns them into a status and a code the client can switch on.
+// Wrap them with fmt.Errorf("...: %w", ErrX) or upstream() to keep the cause for the log.
+var (
+	ErrNotFound         = errors.New("not found")
+	ErrUserExists       = errors.New("user already exists")
+	ErrConflict         = errors.New("conflict") // changed by someone else since it was read
+	ErrBadCredentials   = errors.New("wrong username or password")
+	ErrUnauthorized     = errors.New("unauthorized")    // missing, invalid or revoked token
+	ErrForbidden        = errors.New("forbidden")       // logged in but not allowed, e.g. someone else's post
+	ErrUpstream         = errors.New("upstream failed") // Elasticsearch, GCS, BigTable or the face scorer
+	ErrRateLimited      = errors.New("too many requests")
+	ErrUnsupportedMedia = errors.New("unsupported media type") // upload that is not an accepted image or video
+)
+
+// error codes of the JSON body, stable so the client can switch on them
+const (
+	CODE_INVALID_FIELD   = "invalid_field"
+	CODE_NOT_FOUND       = "not_found"
+	CODE_USER_EXISTS     = "user_exists"
+	CODE_CONFLICT        = "conflict"
+	CODE_BAD_CREDENTIALS = "bad_credentials"
+	CODE_UNAUTHORIZED    = "unauthorized"
+	CODE_FORBIDDEN       = "forbidden"
+	CODE_UPSTREAM        = "upstream_error"
+	CODE_RATE_LIMITED    = "rate_limited"
+	CODE_TOO_LARGE       = "too_large"
+	CODE_UNSUPPORTED     = "unsupported_media"
+	CODE_TIMEOUT         = "timeout"
+	CODE_INTERNAL        = "internal_error"
+)
+
+// errorBody is the JSON of every error response
+type errorBody struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Field     string `json:"field,omitempty"` // bad parameter, only with invalid_field
+	RequestID string `json:"request_id"`      // also in the X-Request-ID header and the server log
+}
+
+// upstreamError is a failure of a backend service, it matches ErrUpstream and unwraps to the cause
+type upstreamError struct {
+	Service string
+	Err     error
+}
+
+func (e *upstreamError) Error() string        { return e.Service + ": " + e.Err.Error() }
+func (e *upstreamError) Unwrap() error        { return e.Err }
+func (e *upstreamError) Is(target error) bool { return target == ErrUpstream }
+
+// rateLimitError is a refused request, it matches ErrRateLimited and tells the client when to come back
+type rateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string        { return "rate limited, retry after " + e.RetryAfter.String() }
+func (e *rateLimitError) Is(target error) bool { return target == ErrRateLimited }
+
+// upstream marks err as a failure of service, nil and errors that already mean something (not found, ...) pass through
+func upstream(service string, err error) error {
+	if err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, ErrConflict) || errors.Is(err, ErrUpstream) {
+		return err
+	}
+	return &upstreamError{Service: service, Err: err}
+}
+
+// errorStatus maps err to an HTTP status and error code, anything unknown is a 500
+func errorStatus(err error) (int, string) {
+	var fe *fieldError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &fe):
+		return http.StatusBadRequest, CODE_INVALID_FIELD
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound, CODE_NOT_FOUND
+	case errors.Is(err, ErrUserExists):
+		return http.StatusConflict, CODE_USER_EXISTS
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict, CODE_CONFLICT
+	case errors.Is(err, ErrBadCredentials):
+		return http.StatusUnauthorized, CODE_BAD_CREDENTIALS
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized, CODE_UNAUTHORIZED
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden, CODE_FORBIDDEN
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests, CODE_RATE_LIMITED
+	case errors.As(err, &tooLarge): // max_upload_size
+		return http.StatusRequestEntityTooLarge, CODE_TOO_LARGE
+	case errors.Is(err, ErrUnsupportedMedia):
+		return http.StatusUnsupportedMediaType, CODE_UNSUPPORTED
+	case errors.Is(err, context.DeadlineExceeded): // store_timeout ran out
+		return http.StatusGatewayTimeout, CODE_TIMEOUT
+	case errors.Is(err, ErrUpstream):
+		return http.StatusBadGateway, CODE_UPSTREAM
+	default:
+		return http.StatusInternalServerError, CODE_INTERNAL
+	}
+}
+
+// writeError answers with the status and code of err. message is what the client reads, err is only logged
+// since it can hold index names, hosts and the like. A field error brings its own message.
+func writeError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	status, code := errorStatus(err)
+	body := errorBody{Code: code, Message: message, RequestID: requestIDFromRequest(r)}
+	var fe *fieldError
+	if errors.As(err, &fe) {
+		body.Field, body.Message = fe.Field, fe.Message
+	}
+	var rl *rateLimitError
+	if errors.As(err, &rl) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rl.RetryAfter.Seconds())))) // whole seconds, rounded up
+	}
+
+	js, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(js)
+	level := slog.LevelWarn // the client's mistake
+	if status >= 500 {
+		level = slog.LevelError
+	}
+	logFor(r.Context()).Log(r.Context(), level, message, "status", status, "code", code, "error", err)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+const (
+	ES_MAX_IDLE_CONNS       = 32               // kept-alive connections to Elasticsearch, enough for the handlers running at once
+	ES_HEALTHCHECK_INTERVAL = 30 * time.Second // dead nodes are retried this often
+	ES_RETRY_MIN            = 100 * time.Millisecond
+	ES_RETRY_MAX            = 5 * time.Second // the backoff gives up once the wait would exceed this
+)
+
+var esClient *elastic.Client // shared by every Elasticsearch call, created once in main by connectES
+
+// esRetryStatus are answers of an overloaded or recovering cluster, it did not run the request so it is safe to send again
+var esRetryStatus = map[int]bool{http.StatusTooManyRequests: true, http.StatusServiceUnavailable: true}
+
+// connectES creates the long-lived client. Connection errors and esRetryStatus answers are retried with exponential
+// backoff, a failed node is marked dead and checked again in the background.
+func connectES(url string) (*elastic.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = ES_MAX_IDLE_CONNS
+	transport.MaxIdleConnsPerHost = ES_MAX_IDLE_CONNS // the default of 2 would reconnect under any load
+
+	backoff := elastic.NewExponentialBackoff(ES_RETRY_MIN, ES_RETRY_MAX)
+	return elastic.NewClient(
+		elastic.SetURL(url),
+		elastic.SetSniff(false), // single node or behind a load balancer
+		elastic.SetHttpClient(&http.Client{Transport: &esTransport{transport, backoff}}), // no client timeout, every call has a context deadline
+		elastic.SetHealthcheckInterval(ES_HEALTHCHECK_INTERVAL),
+		elastic.SetHealthcheckTimeoutStartup(config.StoreTimeout),
+		elastic.SetRetrier(&esRetrier{backoff}),
+	)
+}
+
+// esRetrier retries every failed request with backoff until the wait would exceed ES_RETRY_MAX or ctx is done.
+// The client only asks it about transport errors, esTransport retries esRetryStatus answers with the same backoff.
+type esRetrier struct {
+	backoff elastic.Backoff
+}
+
+func (r *esRetrier) Retry(ctx context.Context, retry int, req *http.Request, resp *http.Response, err error) (time.Duration, bool, error) {
+	if ctx.Err() != nil { // the caller gave up, another try cannot finish in time
+		return 0, false, nil
+	}
+	wait, ok := r.backoff.Next(retry)
+	return wait, ok, nil
+}
+
+// storeContext bounds one storage call by store_timeout, on top of any deadline or cancellation of ctx
+func storeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, config.StoreTimeout)
+}
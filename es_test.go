@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// roundTripFunc answers requests without a network
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestESTransportRetryStatus(t *testing.T) {
+	setupMemory(t)
+	tests := []struct {
+		name     string
+		statuses []int // answers in order, the last one repeats
+		want     int
+		attempts int
+	}{
+		{"ok", []int{200}, 200, 1},
+		{"not found", []int{404}, 404, 1},
+		{"server error", []int{500}, 500, 1},
+		{"recovers", []int{503, 429, 200}, 200, 3},
+		{"gives up", []int{429}, 429, 3}, // the first try and the two retries of the backoff
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var bodies []string
+			var closed []bool
+			transport := &esTransport{roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				js, _ := io.ReadAll(r.Body)
+				bodies = append(bodies, string(js))
+				status := tt.statuses[len(tt.statuses)-1]
+				if len(bodies) <= len(tt.statuses) {
+					status = tt.statuses[len(bodies)-1]
+				}
+				closed = append(closed, false)
+				return &http.Response{StatusCode: status, Body: &closeRecorder{Reader: strings.NewReader("{}"), closed: &closed[len(closed)-1]}}, nil
+			}), elastic.NewSimpleBackoff(1, 1, 1)} // two retries, Next is asked from retry 1
+
+			req := httptest.NewRequest("POST", "http://es:9200/post/_search", strings.NewReader(`{"size":0}`))
+			resp, err := transport.RoundTrip(req)
+			if err != nil || resp.StatusCode != tt.want {
+				t.Fatalf("resp %v, err %v, want status %d", resp, err, tt.want)
+			}
+			if len(bodies) != tt.attempts {
+				t.Errorf("%d attempts, want %d", len(bodies), tt.attempts)
+			}
+			for i, body := range bodies {
+				if body != `{"size":0}` {
+					t.Errorf("attempt %d sent %q", i+1, body)
+				}
+				if last := i == len(bodies)-1; closed[i] == last {
+					t.Errorf("attempt %d body closed = %v", i+1, closed[i])
+				}
+			}
+		})
+	}
+}
+
+func TestESTransportRetryStopsWithContext(t *testing.T) {
+	setupMemory(t)
+	transport := &esTransport{roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: io.NopCloser(strings.NewReader("{}"))}, nil
+	}), elastic.NewConstantBackoff(time.Hour)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("GET", "http://es:9200/post/_search", nil).WithContext(ctx)
+	if _, err := transport.RoundTrip(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the deadline", err)
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed *bool
+}
+
+func (c *closeRecorder) Close() error {
+	*c.closed = true
+	return nil
+}
+
+func TestESRetrier(t *testing.T) {
+	r := &esRetrier{elastic.NewExponentialBackoff(ES_RETRY_MIN, ES_RETRY_MAX)}
+	err := &httpStatusError{http.StatusTooManyRequests}
+
+	wait, ok, rerr := r.Retry(context.Background(), 1, nil, nil, err)
+	if !ok || rerr != nil || wait <= 0 || wait > ES_RETRY_MAX {
+		t.Errorf("first retry = %v, %v, %v, want a wait up to %v", wait, ok, rerr, ES_RETRY_MAX)
+	}
+
+	retries := 0
+	for ; retries < 100; retries++ {
+		if _, ok, _ := r.Retry(context.Background(), retries+1, nil, nil, err); !ok {
+			break
+		}
+	}
+	if retries == 0 || retries == 100 {
+		t.Errorf("gave up after %d retries, want a few", retries)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	if _, ok, _ := r.Retry(ctx, 1, nil, nil, err); ok {
+		t.Error("retried after the context ended")
+	}
+}
+
+func TestESOperation(t *testing.T) {
+	tests := []struct {
+		method, path, want string
+	}{
+		{"POST", "/post/_search", "search"},
+		{"POST", "/post/_search/scroll", "search"},
+		{"POST", "/token/_update_by_query", "update_by_query"},
+		{"POST", "/token/token/abc/_update", "update"},
+		{"POST", "/_aliases", "aliases"},
+		{"GET", "/_cluster/health", "cluster"},
+		{"GET", "/user/user/alice", "get"},
+		{"PUT", "/user/user/alice", "index"},
+		{"DELETE", "/post/post/p1", "delete"},
+		{"HEAD", "/", "get"},
+		{"GET", "/user/user/_alice", "other"}, // usernames may start with '_'
+		{"PUT", "/user/user/_x1", "other"},
+		{"POST", "/user/user/_alice/_update", "update"},
+	}
+	for _, tt := range tests {
+		if got := esOperation(httptest.NewRequest(tt.method, "http://es:9200"+tt.path, nil)); got != tt.want {
+			t.Errorf("%s %s = %q, want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+const (
+	SEARCH_RADIUS  = "radius"  // lat, lon and range
+	SEARCH_BOX     = "box"     // top_left and bottom_right corners, e.g. the map viewport
+	SEARCH_POLYGON = "polygon" // GeoJSON polygon, e.g. a drawn neighborhood
+)
+
+// BoundingBox is a lat/lon rectangle, Left > Right means it crosses the 180th meridian
+type BoundingBox struct {
+	Top, Left, Bottom, Right float64
+}
+
+// Contains reports whether loc is inside the box, edges included
+func (b BoundingBox) Contains(loc Location) bool {
+	if loc.Lat > b.Top || loc.Lat < b.Bottom {
+		return false
+	}
+	if b.Left <= b.Right {
+		return loc.Lon >= b.Left && loc.Lon <= b.Right
+	}
+	return loc.Lon >= b.Left || loc.Lon <= b.Right
+}
+
+// parseCorner reads a "lat,lon" pair
+func parseCorner(name, val string) (Location, error) {
+	if strings.TrimSpace(val) == "" {
+		return Location{}, invalidField(name, "%s is required", name)
+	}
+	parts := strings.Split(val, ",")
+	if len(parts) != 2 {
+		return Location{}, invalidField(name, "%s must be lat,lon", name)
+	}
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	lon, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err1 != nil || err2 != nil {
+		return Location{}, invalidField(name, "%s must be lat,lon", name)
+	}
+	if !(lat >= -90 && lat <= 90) || !(lon >= -180 && lon <= 180) {
+		return Location{}, invalidField(name, "%s must be within -90..90, -180..180", name)
+	}
+	return Location{Lat: lat, Lon: lon}, nil
+}
+
+// parseBoundingBox reads the top_left and bottom_right corners
+func parseBoundingBox(topLeft, bottomRight string) (BoundingBox, error) {
+	tl, err := parseCorner("top_left", topLeft)
+	if err != nil {
+		return BoundingBox{}, err
+	}
+	br, err := parseCorner("bottom_right", bottomRight)
+	if err != nil {
+		return BoundingBox{}, err
+	}
+	if tl.Lat < br.Lat {
+		return BoundingBox{}, invalidField("top_left", "top_left must be north of bottom_right")
+	}
+	return BoundingBox{Top: tl.Lat, Left: tl.Lon, Bottom: br.Lat, Right: br.Lon}, nil
+}
+
+// geoJSONPolygon is the part of a GeoJSON Polygon geometry we use, positions are [lon, lat]
+type geoJSONPolygon struct {
+	Type        string        `json:"type"`
+	Coordinates [][][]float64 `json:"coordinates"`
+}
+
+// parsePolygon reads a GeoJSON Polygon and returns its outer ring.
+// geo_polygon has no holes, so a polygon with inner rings is rejected rather than searched wrongly.
+func parsePolygon(val string) ([]Location, error) {
+	var geom geoJSONPolygon
+	if err := json.Unmarshal([]byte(val), &geom); err != nil {
+		return nil, invalidField("polygon", "polygon must be a GeoJSON Polygon")
+	}
+	if geom.Type != "Polygon" || len(geom.Coordinates) == 0 {
+		return nil, invalidField("polygon", "polygon must be a GeoJSON Polygon")
+	}
+	if len(geom.Coordinates) > 1 {
+		return nil, invalidField("polygon", "polygon holes are not supported")
+	}
+
+	var ring []Location
+	for _, position := range geom.Coordinates[0] {
+		if len(position) < 2 {
+			return nil, invalidField("polygon", "polygon positions must be [lon, lat]")
+		}
+		loc := Location{Lat: position[1], Lon: position[0]}
+		if loc.Lat < -90 || loc.Lat > 90 || loc.Lon < -180 || loc.Lon > 180 {
+			return nil, invalidField("polygon", "polygon position is out of range")
+		}
+		ring = append(ring, loc)
+	}
+	if len(ring) > 1 && ring[0] == ring[len(ring)-1] {
+		ring = ring[:len(ring)-1] // GeoJSON rings repeat the first position at the end
+	}
+	if len(ring) < 3 {
+		return nil, invalidField("polygon", "polygon needs at least 3 distinct positions")
+	}
+	return ring, nil
+}
+
+// polygonContains is the even-odd ray casting test on the lat/lon plane, the same approximation geo_polygon uses
+func polygonContains(ring []Location, loc Location) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.Lat > loc.Lat) != (b.Lat > loc.Lat) &&
+			loc.Lon < (b.Lon-a.Lon)*(loc.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestPolygonContains(t *testing.T) {
+	square := []Location{{Lat: 0, Lon: 0}, {Lat: 0, Lon: 10}, {Lat: 10, Lon: 10}, {Lat: 10, Lon: 0}}
+	// a U open to the north, its notch is outside
+	u := []Location{
+		{Lat: 0, Lon: 0}, {Lat: 0, Lon: 30}, {Lat: 30, Lon: 30}, {Lat: 30, Lon: 20},
+		{Lat: 10, Lon: 20}, {Lat: 10, Lon: 10}, {Lat: 30, Lon: 10}, {Lat: 30, Lon: 0},
+	}
+
+	tests := []struct {
+		name string
+		ring []Location
+		loc  Location
+		want bool
+	}{
+		{"square center", square, Location{Lat: 5, Lon: 5}, true},
+		{"square east", square, Location{Lat: 5, Lon: 15}, false},
+		{"square north", square, Location{Lat: 15, Lon: 5}, false},
+		{"square south west", square, Location{Lat: -1, Lon: -1}, false},
+		{"u left arm", u, Location{Lat: 20, Lon: 5}, true},
+		{"u right arm", u, Location{Lat: 20, Lon: 25}, true},
+		{"u base", u, Location{Lat: 5, Lon: 15}, true},
+		{"u notch", u, Location{Lat: 20, Lon: 15}, false},
+	}
+	for _, tt := range tests {
+		if got := polygonContains(tt.ring, tt.loc); got != tt.want {
+			t.Errorf("%s: polygonContains(%+v) = %v, want %v", tt.name, tt.loc, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const READY_TIMEOUT = 2 * time.Second // per dependency, the load balancer probes again soon anyway
+
+// set at build time, e.g. go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD)"
+var (
+	version   = "dev"
+	commit    = ""
+	buildTime = ""
+)
+
+// dependencyStatus is one backend in the /readyz response
+type dependencyStatus struct {
+	Status    string `json:"status"` // ok or error, the error itself is only logged, it can name hosts and buckets
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+// readiness is the /readyz response
+type readiness struct {
+	Status       string                      `json:"status"` // ok only if every dependency is ok
+	Dependencies map[string]dependencyStatus `json:"dependencies"`
+}
+
+// buildInfo is the /version response
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// readinessChecks lists a check for every backend this config uses
+func readinessChecks() map[string]func(ctx context.Context) error {
+	checks := map[string]func(ctx context.Context) error{
+		"media_" + config.MediaStore:       mediaStore.Ping,
+		"face_scorer_" + config.FaceScorer: faceScorer.Ping,
+	}
+	if config.needsES() {
+		checks[STORE_ELASTICSEARCH] = pingES
+	}
+	if config.BigtableEnabled {
+		checks["bigtable"] = pingBigTable
+	}
+	if config.RateLimiter == LIMITER_REDIS {
+		checks["rate_limiter_redis"] = rateLimiter.Ping
+	}
+	return checks
+}
+
+func pingES(ctx context.Context) error {
+	health, err := esClient.ClusterHealth().Do(ctx)
+	if err != nil {
+		return err
+	}
+	if health.Status == "red" { // yellow is normal for a single node
+		return fmt.Errorf("cluster %s is red", health.ClusterName)
+	}
+	return nil
+}
+
+func pingBigTable(ctx context.Context) error {
+	_, err := btClient.Open("post").ReadRow(ctx, "readyz") // a missing row is fine, a missing table or permission is not
+	return err
+}
+
+// handlerHealthz only says the process is up and serving, restarting it is the fix if this fails
+func handlerHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// handlerReadyz checks every configured backend in parallel, 503 takes the instance out of the load balancer.
+// It is public, so it only uses the long-lived clients and reports no error details.
+func handlerReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	resp := readiness{Status: "ok", Dependencies: map[string]dependencyStatus{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range readinessChecks() {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context) error) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), READY_TIMEOUT)
+			defer cancel()
+
+			start := time.Now()
+			err := check(ctx)
+			status := dependencyStatus{Status: "ok", LatencyMS: time.Since(start).Nanoseconds() / int64(time.Millisecond)}
+			if err != nil {
+				status.Status = "error"
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			resp.Dependencies[name] = status
+			if err != nil {
+				resp.Status = "unavailable"
+				logFor(r.Context()).Warn("Readiness check failed", "dependency", name, "error", err)
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, r, err, "Failed to parse readiness into JSON format")
+		return
+	}
+	if resp.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(js)
+}
+
+// handlerVersion reports the build, falling back to the VCS info go build embeds when no -ldflags were given
+func handlerVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	info := buildInfo{Version: version, Commit: commit, BuildTime: buildTime, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildTime == "":
+				info.BuildTime = s.Value
+			}
+		}
+	}
+
+	js, err := json.Marshal(info)
+	if err != nil {
+		writeError(w, r, err, "Failed to parse version into JSON format")
+		return
+	}
+	w.Write(js)
+}
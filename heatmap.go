@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+const (
+	MAX_ZOOM          = 20    // web map zoom levels are 0 (whole world) to about 20 (buildings)
+	MAX_HEATMAP_CELLS = 10000 // same as the geohash_grid default size
+)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// HeatmapFilter narrows the posts counted in a heatmap, zero values mean no filter
+type HeatmapFilter struct {
+	Type    string  // "image" or "video"
+	MinFace float64 // face score >= MinFace
+}
+
+// HeatCell is one geohash cell with its number of posts, Location is the centroid of those posts
+type HeatCell struct {
+	Geohash  string   `json:"geohash"`
+	Location Location `json:"location"`
+	Count    int64    `json:"count"`
+}
+
+// Heatmap is the response of /heatmap
+type Heatmap struct {
+	Precision int        `json:"precision"`
+	Cells     []HeatCell `json:"cells"`
+}
+
+// zoomToPrecision picks a geohash length giving a few dozen cells across a map viewport at zoom,
+// each extra geohash character is about 2.5 zoom levels. MAX_ZOOM gives 9, within the 12 Elasticsearch accepts.
+func zoomToPrecision(zoom int) int {
+	return zoom*2/5 + 1
+}
+
+// encodeGeohash returns the geohash of loc with precision characters
+func encodeGeohash(loc Location, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	hash := make([]byte, 0, precision)
+	bit, ch, even := 0, 0, true // bits alternate between lon and lat, lon first
+	for len(hash) < precision {
+		rng, val := &latRange, loc.Lat
+		if even {
+			rng, val = &lonRange, loc.Lon
+		}
+		mid := (rng[0] + rng[1]) / 2
+		ch <<= 1
+		if val >= mid {
+			ch |= 1
+			rng[0] = mid
+		} else {
+			rng[1] = mid
+		}
+		even = !even
+		if bit++; bit == 5 {
+			hash = append(hash, geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// heatmapFromES counts the posts in box per geohash cell with a geohash_grid aggregation
+func heatmapFromES(ctx context.Context, box BoundingBox, precision int, filter HeatmapFilter) ([]HeatCell, error) {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+	ctx, span := startSpan(ctx, "heatmapFromES", attribute.Int("geohash.precision", precision))
+
+	query := elastic.NewBoolQuery().Filter(elastic.NewGeoBoundingBoxQuery("location").
+		TopLeft(box.Top, box.Left).
+		BottomRight(box.Bottom, box.Right))
+	if filter.Type != "" {
+		query = query.Filter(elastic.NewTermQuery("type", filter.Type))
+	}
+	if filter.MinFace > 0 {
+		query = query.Filter(elastic.NewRangeQuery("face").Gte(filter.MinFace))
+	}
+	grid := elastic.NewGeoHashGridAggregation().
+		Field("location").
+		Precision(precision).
+		Size(MAX_HEATMAP_CELLS).
+		SubAggregation("centroid", elastic.NewGeoCentroidAggregation().Field("location"))
+
+	searchResult, err := esClient.Search().
+		Index(POST_INDEX).
+		Query(query).
+		Size(0). // only the buckets, no hits
+		Aggregation("cells", grid).
+		Do(ctx)
+	if err != nil {
+		return nil, endSpan(span, err)
+	}
+	logFor(ctx).Debug("Heatmap query finished", "took_ms", searchResult.TookInMillis)
+	span.SetAttributes(attribute.Int64("es.took_ms", searchResult.TookInMillis))
+
+	buckets, ok := searchResult.Aggregations.GeoHash("cells")
+	if !ok {
+		return nil, endSpan(span, nil)
+	}
+	var cells []HeatCell
+	for _, bucket := range buckets.Buckets {
+		hash, _ := bucket.Key.(string)
+		cell := HeatCell{Geohash: hash, Count: bucket.DocCount}
+		if centroid, ok := bucket.Aggregations.GeoCentroid("centroid"); ok && centroid.Count > 0 {
+			cell.Location = Location{Lat: centroid.Location.Latitude, Lon: centroid.Location.Longitude}
+		}
+		cells = append(cells, cell)
+	}
+	span.SetAttributes(attribute.Int("heatmap.cells", len(cells)))
+	return cells, endSpan(span, nil)
+}
+
+// parseHeatmapFilter reads the optional type and min_face parameters
+func parseHeatmapFilter(r *http.Request) (HeatmapFilter, error) {
+	var filter HeatmapFilter
+	switch t := r.URL.Query().Get("type"); t {
+	case "", "image", "video":
+		filter.Type = t
+	default:
+		return filter, invalidField("type", "type must be image or video")
+	}
+	if val := r.URL.Query().Get("min_face"); val != "" {
+		face, err := strconv.ParseFloat(val, 64)
+		if err != nil || !(face >= 0 && face <= 1) { // NaN passes face < 0 || face > 1
+			return filter, invalidField("min_face", "min_face must be between 0 and 1")
+		}
+		filter.MinFace = face
+	}
+	return filter, nil
+}
+
+func handlerHeatmap(w http.ResponseWriter, r *http.Request) {
+	logFor(r.Context()).Debug("Received one heatmap request")
+	w.Header().Set("Content-Type", "application/json")
+
+	box, err := parseBoundingBox(r.URL.Query().Get("top_left"), r.URL.Query().Get("bottom_right"))
+	if err != nil {
+		writeError(w, r, err, "Invalid request")
+		return
+	}
+	zoom, err := strconv.Atoi(r.URL.Query().Get("zoom"))
+	if err != nil || zoom < 0 || zoom > MAX_ZOOM {
+		writeError(w, r, invalidField("zoom", "zoom must be between 0 and %d", MAX_ZOOM), "Invalid request")
+		return
+	}
+	filter, err := parseHeatmapFilter(r)
+	if err != nil {
+		writeError(w, r, err, "Invalid request")
+		return
+	}
+
+	precision := zoomToPrecision(zoom)
+	cells, err := postStore.Heatmap(r.Context(), box, precision, filter)
+	if err != nil {
+		writeError(w, r, err, "Failed to read heatmap")
+		return
+	}
+	if cells == nil {
+		cells = []HeatCell{} // [] rather than null
+	}
+	js, err := json.Marshal(Heatmap{Precision: precision, Cells: cells})
+	if err != nil {
+		writeError(w, r, err, "Failed to parse heatmap into JSON format")
+		return
+	}
+	w.Write(js)
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestEncodeGeohash(t *testing.T) {
+	tests := []struct {
+		loc       Location
+		precision int
+		want      string
+	}{
+		{Location{Lat: 57.64911, Lon: 10.40744}, 11, "u4pruydqqvj"}, // the example of geohash.org
+		{Location{Lat: 48.8583, Lon: 2.2945}, 7, "u09tunq"},
+		{Location{Lat: -33.8568, Lon: 151.2153}, 5, "r3gx2"},
+		{Location{Lat: 0, Lon: 0}, 1, "s"},
+		{Location{Lat: -90, Lon: -180}, 4, "0000"},
+		{Location{Lat: 90, Lon: 180}, 4, "zzzz"},
+	}
+	for _, tt := range tests {
+		if got := encodeGeohash(tt.loc, tt.precision); got != tt.want {
+			t.Errorf("encodeGeohash(%+v, %d) = %q, want %q", tt.loc, tt.precision, got, tt.want)
+		}
+	}
+}
+
+func TestZoomToPrecision(t *testing.T) {
+	for zoom, want := range map[int]int{0: 1, 3: 2, 10: 5, MAX_ZOOM: 9} {
+		if got := zoomToPrecision(zoom); got != want {
+			t.Errorf("zoomToPrecision(%d) = %d, want %d", zoom, got, want)
+		}
+	}
+}
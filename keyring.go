@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const LEGACY_KID = "legacy" // kid of config.SigningKey, also used for old tokens without a kid header
+
+// jwtKey is one key of the ring, Private signs and Public verifies (both are the same []byte for HS256)
+type jwtKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private interface{}
+	Public  interface{}
+}
+
+// KeyRing signs with the current key and verifies with any key it holds, selected by the kid header
+type KeyRing struct {
+	current *jwtKey
+	keys    map[string]*jwtKey
+}
+
+var keyRing *KeyRing // built at startup in main
+
+// newKeyRing loads keys given as "kid:alg:path" (HS256 files hold the raw secret, RS256/ES256 files a PEM private key),
+// plus the legacy HS256 secret if set. signingKID picks the key used for new tokens, default is the first entry.
+func newKeyRing(entries []string, legacySecret, signingKID string) (*KeyRing, error) {
+	ring := &KeyRing{keys: make(map[string]*jwtKey)}
+	var order []string
+
+	if legacySecret != "" {
+		ring.keys[LEGACY_KID] = &jwtKey{ID: LEGACY_KID, Method: jwt.SigningMethodHS256, Private: []byte(legacySecret), Public: []byte(legacySecret)}
+	}
+	for _, entry := range entries {
+		key, err := loadJWTKey(entry)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := ring.keys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate jwt key id %q", key.ID)
+		}
+		ring.keys[key.ID] = key
+		order = append(order, key.ID)
+	}
+	if legacySecret != "" {
+		order = append(order, LEGACY_KID) // only signs when nothing else is configured
+	}
+	if len(order) == 0 {
+		return nil, errors.New("no jwt signing key configured")
+	}
+
+	if signingKID == "" {
+		signingKID = order[0]
+	}
+	current, ok := ring.keys[signingKID]
+	if !ok {
+		return nil, fmt.Errorf("jwt signing key %q is not in the key ring", signingKID)
+	}
+	ring.current = current
+	return ring, nil
+}
+
+// loadJWTKey parses one "kid:alg:path" entry
+func loadJWTKey(entry string) (*jwtKey, error) {
+	parts := strings.SplitN(entry, ":", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return nil, fmt.Errorf("jwt key %q is not kid:alg:path", entry)
+	}
+	kid, alg, path := parts[0], strings.ToUpper(parts[1]), parts[2]
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &jwtKey{ID: kid}
+	switch alg {
+	case "HS256":
+		secret := []byte(strings.TrimSpace(string(data)))
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("jwt key %s: empty secret", kid)
+		}
+		key.Method, key.Private, key.Public = jwt.SigningMethodHS256, secret, secret
+	case "RS256":
+		private, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("jwt key %s: %v", kid, err)
+		}
+		key.Method, key.Private, key.Public = jwt.SigningMethodRS256, private, &private.PublicKey
+	case "ES256":
+		private, err := jwt.ParseECPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("jwt key %s: %v", kid, err)
+		}
+		if private.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("jwt key %s: ES256 needs a P-256 key", kid)
+		}
+		key.Method, key.Private, key.Public = jwt.SigningMethodES256, private, &private.PublicKey
+	default:
+		return nil, fmt.Errorf("jwt key %s: unsupported algorithm %q", kid, alg)
+	}
+	return key, nil
+}
+
+// Sign signs claims with the current key and stamps its kid
+func (k *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.current.Method, claims)
+	token.Header["kid"] = k.current.ID
+	return token.SignedString(k.current.Private)
+}
+
+// ValidationKey is the jwt.Keyfunc used by jwtMiddleware, the alg must match the key so a public key can never act as an HMAC secret
+func (k *KeyRing) ValidationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = LEGACY_KID // issued before key rotation
+	}
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown jwt key id %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected jwt algorithm %s for key %s", token.Method.Alg(), kid)
+	}
+	return key.Public, nil
+}
+
+// JWK is the public part of a key as described in RFC 7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"` // RSA modulus
+	E   string `json:"e,omitempty"` // RSA exponent
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"` // EC point
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS lists the asymmetric keys, HMAC secrets are never published
+func (k *KeyRing) JWKS() []JWK {
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks := []JWK{}
+	for _, key := range k.keys {
+		switch public := key.Public.(type) {
+		case *rsa.PublicKey:
+			jwks = append(jwks, JWK{
+				Kty: "RSA", Kid: key.ID, Use: "sig", Alg: key.Method.Alg(),
+				N: b64(public.N.Bytes()),
+				E: b64(big.NewInt(int64(public.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			jwks = append(jwks, JWK{
+				Kty: "EC", Kid: key.ID, Use: "sig", Alg: key.Method.Alg(), Crv: "P-256",
+				X: b64(padTo(public.X.Bytes(), 32)),
+				Y: b64(padTo(public.Y.Bytes(), 32)),
+			})
+		}
+	}
+	sort.Slice(jwks, func(i, j int) bool { return jwks[i].Kid < jwks[j].Kid })
+	return jwks
+}
+
+// padTo left pads b with zeros, EC coordinates must have a fixed length
+func padTo(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func handlerJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300") // verifiers refetch after a rotation
+
+	js, err := json.Marshal(map[string][]JWK{"keys": keyRing.JWKS()})
+	if err != nil {
+		writeError(w, r, err, "Failed to parse keys into JSON format")
+		return
+	}
+	w.Write(js)
+}
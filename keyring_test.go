@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// testKeys writes an HS256 secret, an RSA key, a P-256 and a P-384 key to t's temp dir
+func testKeys(t *testing.T) (hs, rs, es, es384 string, rsaKey *rsa.PrivateKey) {
+	t.Helper()
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	ecPEM := func(curve elliptic.Curve) []byte {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs = write("hs.key", []byte("  hmac-secret\n"))
+	rs = write("rs.pem", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+	es = write("es.pem", ecPEM(elliptic.P256()))
+	es384 = write("es384.pem", ecPEM(elliptic.P384()))
+	return hs, rs, es, es384, rsaKey
+}
+
+func TestNewKeyRing(t *testing.T) {
+	hs, rs, es, es384, _ := testKeys(t)
+
+	tests := []struct {
+		name       string
+		entries    []string
+		legacy     string
+		signingKID string
+		current    string // kid of the signing key, empty if the ring is rejected
+		want       string // part of the error
+	}{
+		{"legacy only", nil, "secret", "", LEGACY_KID, ""},
+		{"first entry signs", []string{"a:HS256:" + hs, "b:rs256:" + rs}, "secret", "", "a", ""},
+		{"signing kid", []string{"a:HS256:" + hs, "b:RS256:" + rs}, "", "b", "b", ""},
+		{"legacy by kid", []string{"a:HS256:" + hs}, "secret", LEGACY_KID, LEGACY_KID, ""},
+		{"nothing", nil, "", "", "", "no jwt signing key"},
+		{"unknown signing kid", []string{"a:HS256:" + hs}, "", "c", "", `"c" is not in the key ring`},
+		{"not kid:alg:path", []string{"a:HS256"}, "", "", "", "is not kid:alg:path"},
+		{"empty kid", []string{":HS256:" + hs}, "", "", "", "is not kid:alg:path"},
+		{"duplicate kid", []string{"a:HS256:" + hs, "a:RS256:" + rs}, "", "", "", `duplicate jwt key id "a"`},
+		{"missing file", []string{"a:HS256:" + hs + ".missing"}, "", "", "", "no such file"},
+		{"unknown alg", []string{"a:PS256:" + rs}, "", "", "", `unsupported algorithm "PS256"`},
+		{"RS256 with an EC key", []string{"a:RS256:" + es}, "", "", "", "jwt key a:"},
+		{"ES256 with an RSA key", []string{"a:ES256:" + rs}, "", "", "", "jwt key a:"},
+		{"ES256 with a P-384 key", []string{"a:ES256:" + es384}, "", "", "", "needs a P-256 key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring, err := newKeyRing(tt.entries, tt.legacy, tt.signingKID)
+			if tt.current == "" {
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Errorf("err = %v, want %q", err, tt.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ring.current.ID != tt.current {
+				t.Errorf("signing key = %s, want %s", ring.current.ID, tt.current)
+			}
+		})
+	}
+
+	ring, err := newKeyRing([]string{"a:HS256:" + hs}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret := string(ring.keys["a"].Private.([]byte)); secret != "hmac-secret" {
+		t.Errorf("HS256 secret = %q, want the file trimmed", secret)
+	}
+}
+
+func TestKeyRingSignVerify(t *testing.T) {
+	hs, rs, es, _, _ := testKeys(t)
+	entries := []string{"hs:HS256:" + hs, "rs:RS256:" + rs, "es:ES256:" + es}
+
+	for _, kid := range []string{"hs", "rs", "es", LEGACY_KID} {
+		t.Run(kid, func(t *testing.T) {
+			ring, err := newKeyRing(entries, "legacy-secret", kid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signed, err := ring.Sign(jwt.MapClaims{"username": "alice"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token, err := jwt.Parse(signed, ring.ValidationKey)
+			if err != nil || !token.Valid {
+				t.Fatalf("verify = %v", err)
+			}
+			if token.Header["kid"] != kid || token.Claims.(jwt.MapClaims)["username"] != "alice" {
+				t.Errorf("header %v, claims %v", token.Header, token.Claims)
+			}
+
+			// a ring that only verifies, e.g. after the signing key moved on, still accepts the token
+			other, err := newKeyRing(entries, "legacy-secret", "hs")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := jwt.Parse(signed, other.ValidationKey); err != nil {
+				t.Errorf("verify with another signing key = %v", err)
+			}
+		})
+	}
+}
+
+func TestKeyRingValidationKey(t *testing.T) {
+	hs, rs, _, _, rsaKey := testKeys(t)
+	ring, err := newKeyRing([]string{"hs:HS256:" + hs, "rs:RS256:" + rs}, "legacy-secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(method jwt.SigningMethod, kid string, key interface{}) string {
+		t.Helper()
+		token := jwt.NewWithClaims(method, jwt.MapClaims{"username": "alice"})
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	publicPEM, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"no kid is the legacy key", sign(jwt.SigningMethodHS256, "", []byte("legacy-secret")), true},
+		{"no kid, other secret", sign(jwt.SigningMethodHS256, "", []byte("hmac-secret")), false},
+		{"hs", sign(jwt.SigningMethodHS256, "hs", []byte("hmac-secret")), true},
+		{"rs", sign(jwt.SigningMethodRS256, "rs", rsaKey), true},
+		{"unknown kid", sign(jwt.SigningMethodHS256, "gone", []byte("hmac-secret")), false},
+		{"wrong key for kid", sign(jwt.SigningMethodHS256, "hs", []byte("legacy-secret")), false},
+		// the RSA public key is public, it must not verify an HMAC token claiming the RSA kid
+		{"HS256 with the RSA public key", sign(jwt.SigningMethodHS256, "rs", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicPEM})), false},
+		{"RS256 with the kid of a secret", sign(jwt.SigningMethodRS256, "hs", rsaKey), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := jwt.Parse(tt.token, ring.ValidationKey)
+			if (err == nil) != tt.ok {
+				t.Errorf("verify = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestKeyRingJWKS(t *testing.T) {
+	hs, rs, es, _, rsaKey := testKeys(t)
+	ring, err := newKeyRing([]string{"hs:HS256:" + hs, "rs:RS256:" + rs, "es:ES256:" + es}, "legacy-secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	esKey := ring.keys["es"].Public.(*ecdsa.PublicKey)
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	jwks := ring.JWKS()
+	if len(jwks) != 2 {
+		t.Fatalf("JWKS = %+v, want only the RSA and EC keys, never the HMAC secrets", jwks)
+	}
+	want := []JWK{
+		{Kty: "EC", Kid: "es", Use: "sig", Alg: "ES256", Crv: "P-256", X: b64(padTo(esKey.X.Bytes(), 32)), Y: b64(padTo(esKey.Y.Bytes(), 32))},
+		{Kty: "RSA", Kid: "rs", Use: "sig", Alg: "RS256", N: b64(rsaKey.N.Bytes()), E: "AQAB"},
+	}
+	for i := range want {
+		if jwks[i] != want[i] {
+			t.Errorf("JWKS[%d] = %+v, want %+v", i, jwks[i], want[i])
+		}
+	}
+	for _, c := range []string{jwks[0].X, jwks[0].Y} {
+		if n, _ := base64.RawURLEncoding.DecodeString(c); len(n) != 32 {
+			t.Errorf("EC coordinate is %d bytes, want 32", len(n))
+		}
+	}
+}
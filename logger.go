@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	LOG_FORMAT_JSON = "json"
+	LOG_FORMAT_TEXT = "text" // key=value lines, easier to read on a terminal
+)
+
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil)) // replaced by setupLogger once the config is loaded
+
+// setupLogger points logger at stdout with the configured level and format
+func setupLogger(level, format string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil { // debug, info, warn or error
+		return fmt.Errorf("unknown log_level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+
+	switch format {
+	case LOG_FORMAT_JSON:
+		logger = slog.New(slog.NewJSONHandler(os.Stdout, opts))
+	case LOG_FORMAT_TEXT:
+		logger = slog.New(slog.NewTextHandler(os.Stdout, opts))
+	default:
+		return fmt.Errorf("unknown log_format %q", format)
+	}
+	slog.SetDefault(logger) // the log package, used by net/http for its own errors, ends up here too
+	return nil
+}
+
+// logFor returns logger tagged with the request and trace ids of ctx, if any
+func logFor(ctx context.Context) *slog.Logger {
+	l := logger
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		l = l.With("request_id", id)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		l = l.With("trace_id", sc.TraceID().String())
+	}
+	return l
+}
+
+const accessLogKey contextKey = "access_log"
+
+// accessEntry collects what the access log and the metrics need but only inner handlers know: the matched route and the user
+type accessEntry struct {
+	route string
+	user  string
+}
+
+// withAccessEntry returns the accessEntry of r, adding an unmatched one to the context if r has none yet
+func withAccessEntry(r *http.Request) (*accessEntry, *http.Request) {
+	if entry, ok := r.Context().Value(accessLogKey).(*accessEntry); ok {
+		return entry, r
+	}
+	entry := &accessEntry{route: "unmatched"}
+	return entry, r.WithContext(context.WithValue(r.Context(), accessLogKey, entry))
+}
+
+// withAccessLog writes one line per request with method, route, status, latency and user
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry, r := withAccessEntry(r)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		logFor(r.Context()).Info("request",
+			"method", r.Method,
+			"path", r.URL.Path, // not the query, it holds coordinates and search text
+			"route", entry.route,
+			"status", rec.status,
+			"latency_ms", time.Since(start).Milliseconds(),
+			"user", entry.user,
+			"remote", remoteIP(r),
+		)
+	})
+}
+
+// recordRoute is a router middleware, it runs after matching so the route template is known.
+// It names the access log line, the request metrics and the request span after the route.
+func recordRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tmpl, err := mux.CurrentRoute(r).GetPathTemplate(); err == nil {
+			if entry, ok := r.Context().Value(accessLogKey).(*accessEntry); ok {
+				entry.route = tmpl
+			}
+			span := trace.SpanFromContext(r.Context())
+			span.SetName(r.Method + " " + tmpl)
+			span.SetAttributes(attribute.String("http.route", tmpl))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logUser names the user of r in its access log line and span
+func logUser(r *http.Request, username string) {
+	if entry, ok := r.Context().Value(accessLogKey).(*accessEntry); ok {
+		entry.user = username
+	}
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("enduser.id", username))
+}
+
+// remoteIP is the client address without the port. Behind trusted_proxies load balancers it is the address
+// the outermost one saw, each of them appends the address it got the request from to X-Forwarded-For.
+func remoteIP(r *http.Request) string {
+	if config.TrustedProxies > 0 {
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		if i := len(hops) - config.TrustedProxies; i >= 0 && strings.TrimSpace(hops[i]) != "" { // entries left of it are client supplied
+			return strings.TrimSpace(hops[i])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
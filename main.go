@@ -5,30 +5,28 @@ import (
 	"cloud.google.com/go/storage"
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/gorilla/mux"
 	//"github.com/olivere/elastic" // <- Add this
 	"github.com/pborman/uuid" // <- Add this
 	elastic "gopkg.in/olivere/elastic.v6" // https://godoc.org/github.com/olivere/elastic#example-NewClient--ManyOptions
 	"io"
-	"log"
 	"net/http"
-	"path/filepath"
-	"reflect"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 	// Use JWT to Protect Post and Search Endpoints
 	jwtmiddleware "github.com/auth0/go-jwt-middleware" // https://godoc.org/github.com/auth0/go-jwt-middleware
-	jwt "github.com/dgrijalva/jwt-go"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
-	POST_INDEX          = "post"
-	POST_TYPE           = "post"
-	DISTANCE            = "200km"
-	BUCKET_NAME         = "my-post-images"
-	BIGTABLE_PROJECT_ID = "true-source-241502"
-	BT_INSTANCE         = "around-post"
-	ES_URL              = "http://10.128.0.2:9200" // change this every time when start!!!
+	POST_INDEX = "post"
+	POST_TYPE  = "post"
 	// API_PREFIX       = "/api/v1" // version if any
 )
 
@@ -38,115 +36,230 @@ type Location struct {
 }
 
 type Post struct {
+	ID string `json:"id"` // document id, also the media object name
 	// `json:"user"` is for the json parsing of this User field. Otherwise, by default it's 'User'.
-	User     string   `json:"user"`
-	Message  string   `json:"message"`
-	Location Location `json:"location"`
-	Url      string   `json:"url"`
-	Type     string   `json:"type"` // file type
-	Face     float64  `json:"face"` // predict result
+	User      string    `json:"user"`
+	Message   string    `json:"message"`
+	Location  Location  `json:"location"`
+	Url       string    `json:"url"`
+	Type      string    `json:"type"`       // file type
+	MimeType  string    `json:"mime_type"`  // content type detected from the uploaded bytes
+	Face      float64   `json:"face"`       // predict result
+	Tags      []string  `json:"tags"`       // hashtags of Message, lowercased without '#'
+	CreatedAt time.Time `json:"created_at"` // set by the server, never by clients
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Highlights []string `json:"highlights,omitempty"` // HTML escaped message snippets matching q with <em> around the matches, only in search results
+
+	Version *PostVersion `json:"-"` // set by PostStore.Get, a Save of the post then fails if it changed in between
 }
 
-var ( // upload file type, type -> image or video
-	mediaTypes = map[string]string{
-		".jpeg": "image",
-		".jpg":  "image",
-		".gif":  "image",
-		".png":  "image",
-		".mov":  "video",
-		".mp4":  "video",
-		".avi":  "video",
-		".flv":  "video",
-		".wmv":  "video",
-	}
-)
+// PostVersion is the Elasticsearch seq_no and primary_term of a stored post
+type PostVersion struct {
+	SeqNo       int64
+	PrimaryTerm int64
+}
 
 func main() {
-	fmt.Println("started-service")
+	args := os.Args[1:]
+	migrate := len(args) > 0 && args[0] == "migrate" // "around migrate [flags]" migrates the indices and exits
+	if migrate {
+		args = args[1:]
+	}
+	cfg, err := loadConfig(args) // file, env and flags
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+	config = cfg
+	if err := setupLogger(config.LogLevel, config.LogFormat); err != nil {
+		panic(err)
+	}
+	if migrate { // no store_timeout, a reindex takes as long as it takes
+		if err := runMigrate(context.Background()); err != nil {
+			logger.Error("migration failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := setupTracing(context.Background()); err != nil {
+		panic(err)
+	}
+	keyRing, err = newKeyRing(config.JWTKeys, config.SigningKey, config.JWTSigningKID)
+	if err != nil {
+		panic(err)
+	}
+
+	logger.Info("started-service")
+	logger.Info("effective config", "config", config) // a group of fields, see Config.LogValue
+
+	// one client for the whole process, only if a store keeps its data in Elasticsearch
+	if config.needsES() {
+		if esClient, err = connectES(config.ESURL); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := setupRateLimits(); err != nil {
+		panic(err)
+	}
+
+	store, err := newPostStore(config.PostStore)
+	if err != nil {
+		panic(err)
+	}
+	if err := store.EnsureSchema(context.Background()); err != nil { // create elastic search index if needed
+		panic(err)
+	}
+	postStore = store
+
+	userStore, err = newUserStore(config.UserStore)
+	if err != nil {
+		panic(err)
+	}
+	if err := userStore.EnsureSchema(context.Background()); err != nil { // create the user index if needed
+		panic(err)
+	}
+
+	mediaStore, err = newMediaStore(config.MediaStore, config.MediaDir, config.MediaURL)
+	if err != nil {
+		panic(err)
+	}
+
+	if config.BigtableEnabled {
+		btClient, err = bigtable.NewClient(context.Background(), config.BigtableProject, config.BigtableInstance)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	faceScorer, err = newFaceScorer(config.FaceScorer, config.TFServingURL, config.StaticFaceScore)
+	if err != nil {
+		panic(err)
+	}
 
-	createIndexIfNotExist() // create elastic search
+	tokenStore, err = newTokenStore(config.TokenStore)
+	if err != nil {
+		panic(err)
+	}
+	if err := tokenStore.EnsureSchema(context.Background()); err != nil {
+		panic(err)
+	}
 	// token操作jwtMiddleware
 	jwtMiddleware := jwtmiddleware.New(jwtmiddleware.Options{
-		ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) { // take a token return a sign in key. The function that will return the Key to validate the JWT.
-			return []byte(mySigningKey), nil
+		// take a token return the key of its kid. The algorithm is checked per key, so no fixed SigningMethod here
+		ValidationKeyGetter: keyRing.ValidationKey,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err string) { // same JSON error body as the handlers
+			writeError(w, r, fmt.Errorf("%s: %w", err, ErrUnauthorized), "Invalid or missing token")
 		},
-		SigningMethod: jwt.SigningMethodHS256, // decryption algorithm
 	}) // token验证集成
 
 	r := mux.NewRouter() // gorilla/mux library, https://www.gorillatoolkit.org/pkg/mux, 
 	// .Handle() registers a new route with a matcher for the URL path, Router implements the http.Handler interface, so it can be registered to serve requests
 	//.Methods() match HTTP methods
-	r.Handle("/post", jwtMiddleware.Handler(http.HandlerFunc(handlerPost))).Methods("POST", "OPTIONS")    // handle with jwt middleware
-	r.Handle("/search", jwtMiddleware.Handler(http.HandlerFunc(handlerSearch))).Methods("GET", "OPTIONS") // hanle with ...
-	r.Handle("/cluster", jwtMiddleware.Handler(http.HandlerFunc(handlerCluster))).Methods("GET", "OPTIONS")
-	r.Handle("/signup", http.HandlerFunc(handlerSignup)).Methods("POST", "OPTIONS")
-	r.Handle("/login", http.HandlerFunc(handlerLogin)).Methods("POST", "OPTIONS")
-
-	http.Handle("/", r)
+	r.Handle("/post", jwtMiddleware.Handler(notRevoked(http.HandlerFunc(handlerPost)))).Methods("POST") // handle with jwt middleware
+	r.Handle("/post/{id}", jwtMiddleware.Handler(notRevoked(http.HandlerFunc(handlerGetPost)))).Methods("GET")
+	r.Handle("/post/{id}", jwtMiddleware.Handler(notRevoked(http.HandlerFunc(handlerUpdatePost)))).Methods("PUT")
+	r.Handle("/post/{id}", jwtMiddleware.Handler(notRevoked(http.HandlerFunc(handlerDeletePost)))).Methods("DELETE")
+	r.Handle("/search", jwtMiddleware.Handler(notRevoked(http.HandlerFunc(handlerSearch)))).Methods("GET") // hanle with ...
+	r.Handle("/tags/{tag}", jwtMiddleware.Handler(notRevoked(http.HandlerFunc(handlerTags)))).Methods("GET")
+	r.Handle("/heatmap", jwtMiddleware.Handler(notRevoked(http.HandlerFunc(handlerHeatmap)))).Methods("GET")
+	r.Handle("/cluster", jwtMiddleware.Handler(notRevoked(http.HandlerFunc(handlerCluster)))).Methods("GET")
+	r.Handle("/logout", jwtMiddleware.Handler(notRevoked(http.HandlerFunc(handlerLogout)))).Methods("POST")
+	r.Handle("/signup", http.HandlerFunc(handlerSignup)).Methods("POST")
+	r.Handle("/login", http.HandlerFunc(handlerLogin)).Methods("POST")
+	r.Handle("/token/refresh", http.HandlerFunc(handlerRefresh)).Methods("POST")     // refresh token is in the body, no jwt
+	r.Handle("/.well-known/jwks.json", http.HandlerFunc(handlerJWKS)).Methods("GET") // public keys for other services
+	r.Handle("/media/{id}", http.HandlerFunc(handlerMedia)).Methods("GET")           // public, used in <img>/<video> tags
+	r.Handle("/healthz", http.HandlerFunc(handlerHealthz)).Methods("GET")            // liveness, no jwt so probes can call it
+	r.Handle("/readyz", http.HandlerFunc(handlerReadyz)).Methods("GET")              // readiness, checks the backends
+	r.Handle("/version", http.HandlerFunc(handlerVersion)).Methods("GET")
+	r.Use(recordRoute) // runs after routing, so the route template is known
+
+	// every response, errors included, carries X-Request-ID, gets an access log line and a span, joining the caller's trace.
+	// CORS preflights are answered before the router, so before any JWT check.
+	http.Handle("/", otelhttp.NewHandler(withRequestID(withAccessLog(withCORS(metricsMiddleware(r)))), "http.request",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string { return r.Method }), // recordRoute adds the route
+	))
 
 	// func HandleFunc(pattern string, handler func(ResponseWriter, *Request))
 	// HandleFunc registers the handler function for the given pattern in the DefaultServeMux.
 	// http.HandleFunc("/post", handlerPost)
 	// http.HandleFunc("/search", handlerSearch)
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	var metrics *http.Server // /metrics has its own listener, see metrics_addr
+	if config.MetricsAddr != "" {
+		metrics = newMetricsServer()
+	}
+	if err := runServer(newServer(http.DefaultServeMux), metrics); err != nil && err != http.ErrServerClosed {
+		logger.Error("server failed", "error", err)
+		os.Exit(1)
+	}
 }
 
 func handlerPost(w http.ResponseWriter, r *http.Request) {
 	// Parse from body of request to get a json object.
-	fmt.Println("Received one post request")
+	logFor(r.Context()).Debug("Received one post request")
 
 	w.Header().Set("Content-Type", "application/json") // return type
-	w.Header().Set("Access-Control-Allow-Origin", "*") // available to all clients
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization") // 预检请求
 
-	user := r.Context().Value("user") // get user from token
-	claims := user.(*jwt.Token).Claims
-	username := claims.(jwt.MapClaims)["username"] // decrypt and get user name
+	username := usernameFromRequest(r) // get user name from token
 
-	if r.Method == "OPTIONS" {
+	if err := parseUpload(w, r); err != nil { // before any FormValue, that would parse without a limit
+		writeError(w, r, err, "Invalid upload")
 		return
 	}
 
-	lat, _ := strconv.ParseFloat(r.FormValue("lat"), 64)
-	lon, _ := strconv.ParseFloat(r.FormValue("lon"), 64)
+	loc, err := parseLatLon(r.FormValue)
+	if err != nil {
+		writeError(w, r, err, "Invalid request")
+		return
+	}
 
+	id := uuid.New() // returns a new random (version 4) UUID as a string
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(attribute.String("post.id", id))
+	now := time.Now().UTC()
 	p := &Post{
-		User:    username.(string),
-		Message: r.FormValue("message"),
-		Location: Location{
-			Lat: lat,
-			Lon: lon,
-		},
+		ID:        id,
+		User:      username,
+		Message:   r.FormValue("message"),
+		Location:  loc,
+		Tags:      extractTags(r.FormValue("message")),
+		CreatedAt: now,
+		UpdatedAt: now,
 	} // post object
 
-	id := uuid.New() // returns a new random (version 4) UUID as a string
-	file, _, err := r.FormFile("image") // get file
+	// FormFile returns the first file for the provided form key.
+	file, header, err := r.FormFile("image") // get file
 	if err != nil {
-		http.Error(w, "Image is not available", http.StatusBadRequest)
-		fmt.Printf("Image is not available %v.\n", err)
+		writeError(w, r, invalidField("image", "image is required"), "Image is not available")
 		return
 	}
-	attrs, err := saveToGCS(file, BUCKET_NAME, id)
+	defer file.Close()
+	// the extension picks the type, the bytes have to agree, so a renamed file cannot pass for an image
+	mt, mime, err := checkUpload(file, header.Filename)
 	if err != nil {
-		http.Error(w, "Failed to save image to GCS", http.StatusInternalServerError)
-		fmt.Printf("Failed to save image to GCS %v.\n", err)
+		writeError(w, r, err, "Only JPEG, PNG and GIF images and MP4, MOV, AVI, FLV and WMV videos are supported")
 		return
 	}
-	p.Url = attrs.MediaLink // return file url on GCS
+	p.Type, p.MimeType = mt.kind, mime // videos/images
+	span.SetAttributes(attribute.String("media.type", p.Type), attribute.String("media.mime_type", mime), attribute.Int64("media.bytes", header.Size))
 
-	file, header, _ := r.FormFile("image")  // read image
-	// FormFile returns the first file for the provided form key.
-	suffix := filepath.Ext(header.Filename) // file type
-	// Ext returns the file name extension used by path
-	if t, ok := mediaTypes[suffix]; ok {
-		p.Type = t // videos/images
-	} else {
-		p.Type = "unknown"
+	if err := mediaStore.Put(r.Context(), file, id, mime); err != nil {
+		writeError(w, r, err, "Failed to save image")
+		return
+	}
+	p.Url = mediaStore.PublicURL(id) // return file url
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil { // Put read it to the end
+		writeError(w, r, err, "Failed to read image")
+		return
 	}
-	if suffix == ".jpeg" { // default type is .jpeg, else 0.0
-		if score, err := annotate(file); err != nil {
-			http.Error(w, "Failed to annotate the image", http.StatusInternalServerError)
-			fmt.Printf("Failed to annotate the image %v\n", err)
+	if mime == "image/jpeg" { // the model only knows jpeg, else 0.0
+		if score, err := faceScorer.Score(r.Context(), file); err != nil {
+			writeError(w, r, err, "Failed to annotate the image")
 			return
 		} else {
 			p.Face = score
@@ -155,20 +268,28 @@ func handlerPost(w http.ResponseWriter, r *http.Request) {
 		p.Face = 0.0
 	}
 
-	err = saveToES(p, id)
+	err = postStore.Save(r.Context(), p, id)
 	if err != nil {
-		http.Error(w, "Failed to save post to ElasticSearch", http.StatusInternalServerError)
-		fmt.Printf("Failed to save post to ElasticSearch %v.\n", err)
+		writeError(w, r, err, "Failed to save post")
 		return
 	}
-	fmt.Printf("Saved one post to ElasticSearch: %s\n", p.Message)
+	logFor(r.Context()).Info("Saved one post", "id", id) // never the message, it is user content
 
-	//err = saveToBigTable(p, id) // to use big table and big query
-	//if err != nil {
-	//	http.Error(w, "Failed to save post to BigTable", http.StatusInternalServerError)
-	//	fmt.Printf("Failed to save post to BigTable %v.\n", err)
-	//	return
-	//}
+	if config.BigtableEnabled { // to use big table and big query
+		err = saveToBigTable(r.Context(), p, id)
+		if err != nil {
+			writeError(w, r, upstream("bigtable", err), "Failed to save post to BigTable")
+			return
+		}
+	}
+
+	js, err := json.Marshal(p) // return the created post, clients need its id
+	if err != nil {
+		writeError(w, r, err, "Failed to parse post into JSON format")
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(js)
 
 	/*
 		// Parse from body of request to get a json object.
@@ -200,41 +321,69 @@ func handlerPost(w http.ResponseWriter, r *http.Request) {
 }
 
 func handlerSearch(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Received one request for search")
+	logFor(r.Context()).Debug("Received one request for search")
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
-
-	if r.Method == "OPTIONS" {
-		return
-	}
 
-	lat, _ := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
-	lon, _ := strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
-	// range is optional
-	ran := DISTANCE
-	if val := r.URL.Query().Get("range"); val != "" {
-		ran = val + "km"
+	// radius around lat/lon by default, box and polygon have no center so they cannot sort by distance
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = SEARCH_RADIUS
+	}
+	var opts SearchOptions
+	var err error
+	switch mode {
+	case SEARCH_RADIUS:
+		opts, err = parseSearchOptions(r, SORT_DISTANCE, SORT_DISTANCE, SORT_NEWEST, SORT_FACE, SORT_RELEVANCE)
+	case SEARCH_BOX, SEARCH_POLYGON:
+		opts, err = parseSearchOptions(r, SORT_NEWEST, SORT_NEWEST, SORT_FACE, SORT_RELEVANCE)
+	default:
+		err = invalidField("mode", "mode must be one of %s, %s, %s", SEARCH_RADIUS, SEARCH_BOX, SEARCH_POLYGON)
 	}
-
-	query := elastic.NewGeoDistanceQuery("location") // construct query
-	query = query.Distance(ran).Lat(lat).Lon(lon)
-
-	posts, err := readFromES(query)
 	if err != nil {
-		http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
-		fmt.Printf("Failed to read post from ElasticSearch %v.\n", err)
+		writeError(w, r, err, "Invalid request")
+		return
+	}
+	opts.Text = strings.TrimSpace(r.URL.Query().Get("q")) // optional words to find in the message
+	if opts.Sort == SORT_RELEVANCE && opts.Text == "" {
+		writeError(w, r, invalidField("q", "sort relevance needs q"), "Invalid request")
 		return
 	}
 
-	js, err := json.Marshal(posts) // Convert the go object to a string
+	var page *PostPage
+	switch mode {
+	case SEARCH_RADIUS:
+		loc, perr := parseLatLon(r.URL.Query().Get)
+		if perr != nil {
+			writeError(w, r, perr, "Invalid request")
+			return
+		}
+		ran, perr := parseRange(r.URL.Query().Get("range")) // range is optional
+		if perr != nil {
+			writeError(w, r, perr, "Invalid request")
+			return
+		}
+		page, err = postStore.GeoSearch(r.Context(), loc.Lat, loc.Lon, ran, opts) // geo distance query
+	case SEARCH_BOX:
+		box, perr := parseBoundingBox(r.URL.Query().Get("top_left"), r.URL.Query().Get("bottom_right"))
+		if perr != nil {
+			writeError(w, r, perr, "Invalid request")
+			return
+		}
+		page, err = postStore.BoxSearch(r.Context(), box, opts) // geo bounding box query
+	case SEARCH_POLYGON:
+		ring, perr := parsePolygon(r.URL.Query().Get("polygon"))
+		if perr != nil {
+			writeError(w, r, perr, "Invalid request")
+			return
+		}
+		page, err = postStore.PolygonSearch(r.Context(), ring, opts) // geo polygon query
+	}
 	if err != nil {
-		http.Error(w, "Failed to parse posts into JSON format", http.StatusInternalServerError)
-		fmt.Printf("Failed to parse posts into JSON format %v.\n", err)
+		writeError(w, r, err, "Failed to read post")
 		return
 	}
 
-	w.Write(js)
+	writePostPage(w, r, page)
 
 	/*
 		fmt.Println("range is ", ran)
@@ -258,113 +407,134 @@ func handlerSearch(w http.ResponseWriter, r *http.Request) {
 		w.Write(js)*/
 }
 
+var clusterTerms = []string{"face"} // numeric post fields /cluster can filter on
+
 func handlerCluster(w http.ResponseWriter, r *http.Request) { // similar to handler search
-	fmt.Println("Received one cluster request")
+	logFor(r.Context()).Debug("Received one cluster request")
 
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
-
-	if r.Method == "OPTIONS" {
+	term := r.URL.Query().Get("term")
+	ok := false
+	for _, t := range clusterTerms {
+		ok = ok || t == term
+	}
+	if !ok {
+		writeError(w, r, invalidField("term", "term must be one of %v", clusterTerms), "Invalid request")
 		return
 	}
-	// func NewRangeQuery(name string) *RangeQuery, creates and initializes a new RangeQuery
-	term := r.URL.Query().Get("term")
-	query := elastic.NewRangeQuery(term).Gte(0.97) // predict threshold, Gte() indicates a greater-than-or-equal value for the from part. 
-
-	posts, err := readFromES(query)
+	opts, err := parseSearchOptions(r, SORT_FACE, SORT_NEWEST, SORT_FACE)
 	if err != nil {
-		http.Error(w, "Failed to read post from ElasticSearch", http.StatusInternalServerError)
-		fmt.Printf("Failed to read post from ElasticSearch %v.\n", err)
+		writeError(w, r, err, "Invalid request")
 		return
 	}
 
-	js, err := json.Marshal(posts)
+	page, err := postStore.RangeSearch(r.Context(), term, 0.97, opts) // predict threshold, term >= 0.97
 	if err != nil {
-		http.Error(w, "Failed to parse post object", http.StatusInternalServerError)
-		fmt.Printf("Failed to parse post object %v\n", err)
+		writeError(w, r, err, "Failed to read post")
 		return
 	}
 
-	w.Write(js)
+	writePostPage(w, r, page)
 }
 
-func createIndexIfNotExist() { // APIs are from "github.com/olivere/elastic", doc "https://godoc.org/github.com/olivere/elastic#example-NewClient--ManyOptions"
-	client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false))  // connect to ES
-	// create a new client to work with ES, SetSniff = distributed storage
-	if err != nil {
-		panic(err)
-	}
+func createIndexIfNotExist(ctx context.Context) error { // APIs are from "github.com/olivere/elastic", doc "https://godoc.org/github.com/olivere/elastic#example-NewClient--ManyOptions"
+	// post is an alias of a versioned index with an explicit mapping, see indexSpecs in migrate.go.
+	// Only created here, changes of the mapping need the migrate command
+	return ensureIndex(ctx, esClient, POST_INDEX)
+}
 
-	exists, err := client.IndexExists(POST_INDEX).Do(context.Background())  // checks if a given index already exists
+// Save a post to ElasticSearch
+func saveToES(ctx context.Context, post *Post, id string) error {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+	ctx, span := startSpan(ctx, "saveToES", attribute.String("post.id", id))
+
+	index := esClient.Index().
+		Index(POST_INDEX). // save to POST
+		Type(POST_TYPE).
+		Id(id).
+		BodyJson(post). // item body
+		Refresh("wait_for")
+	if post.Version != nil { // only if nobody saved it since it was read
+		index = index.IfSeqNo(post.Version.SeqNo).IfPrimaryTerm(post.Version.PrimaryTerm)
+	}
+	result, err := index.Do(ctx) // run
+	if elastic.IsConflict(err) {
+		return endSpan(span, errPostConflict)
+	}
 	if err != nil {
-		panic(err)
+		return endSpan(span, err)
 	}
+	post.Version = &PostVersion{SeqNo: result.SeqNo, PrimaryTerm: result.PrimaryTerm}
 
-	if !exists { // create if not exist
-		mapping := `{
-            "mappings": {
-                "post": {
-                    "properties": {
-                        "location": {
-                            "type": "geo_point"
-                        }
-                    }
-                }
-            }
-        }` // pattern
-		_, err = client.CreateIndex(POST_INDEX).Body(mapping).Do(context.Background()) // CreateIndex returns a service to create a new index.
-		if err != nil {
-			panic(err)
-		}
+	logFor(ctx).Debug("Post is saved to index", "id", id)
+	return endSpan(span, nil)
+}
+
+// Get one post from ElasticSearch by id
+func getFromES(ctx context.Context, id string) (*Post, error) {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+
+	result, err := esClient.Get().
+		Index(POST_INDEX).
+		Type(POST_TYPE).
+		Id(id).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, errPostNotFound
 	}
-	// check if USER index exist
-	exists, err = client.IndexExists(USER_INDEX).Do(context.Background()) // user database
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	// if not, create
-	if !exists {
-		_, err = client.CreateIndex(USER_INDEX).Do(context.Background()) // create user
-		if err != nil {
-			panic(err)
-		}
+	if !result.Found || result.Source == nil {
+		return nil, errPostNotFound
 	}
-}
 
-// Save a post to ElasticSearch
-func saveToES(post *Post, id string) error {
-	client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false)) // connect to ES
-	if err != nil {
-		return err
+	var p Post
+	if err := json.Unmarshal(*result.Source, &p); err != nil {
+		return nil, err
 	}
+	p.ID = result.Id
+	if result.SeqNo != nil && result.PrimaryTerm != nil {
+		p.Version = &PostVersion{SeqNo: *result.SeqNo, PrimaryTerm: *result.PrimaryTerm}
+	}
+	return &p, nil
+}
 
-	_, err = client.Index().
-		Index(POST_INDEX). // save to POST
+// Delete one post from ElasticSearch by id
+func deleteFromES(ctx context.Context, id string) error {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+	ctx, span := startSpan(ctx, "deleteFromES", attribute.String("post.id", id))
+
+	_, err := esClient.Delete().
+		Index(POST_INDEX).
 		Type(POST_TYPE).
 		Id(id).
-		BodyJson(post). // item body
 		Refresh("wait_for").
-		Do(context.Background()) // run
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return endSpan(span, errPostNotFound)
+	}
 	if err != nil {
-		return err
+		return endSpan(span, err)
 	}
 
-	fmt.Printf("Post is saved to index: %s\n", post.Message)
-	return nil
+	logFor(ctx).Debug("Post is deleted from index", "id", id)
+	return endSpan(span, nil)
 }
 
-func saveToBigTable(p *Post, id string) error {
+var btClient *bigtable.Client // shared by every BigTable call, created once in main if bigtable_enabled
 
-	ctx := context.Background()
-	bt_client, err := bigtable.NewClient(ctx, BIGTABLE_PROJECT_ID, BT_INSTANCE) // connect to big table
-	if err != nil {
-		return err
-	}
+func saveToBigTable(ctx context.Context, p *Post, id string) error {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
 
-	tbl := bt_client.Open("post")              // open a table
-	mut := bigtable.NewMutation()              // create record
-	t := bigtable.Now()                        // time stamp
+	ctx, done := trackBackend(ctx, BACKEND_BIGTABLE, "mutate", attribute.String("post.id", id))
+	tbl := btClient.Open("post")  // open a table
+	mut := bigtable.NewMutation() // create record
+	t := bigtable.Now()           // time stamp
 	// Set(family, column string, ts Timestamp, value []byte)
 	// Set sets a value in a specified column, with the given timestamp.
 	mut.Set("post", "user", t, []byte(p.User)) // write message
@@ -372,85 +542,114 @@ func saveToBigTable(p *Post, id string) error {
 	mut.Set("location", "lat", t, []byte(strconv.FormatFloat(p.Location.Lat, 'f', -1, 64)))
 	mut.Set("location", "lon", t, []byte(strconv.FormatFloat(p.Location.Lon, 'f', -1, 64)))
 
-	err = tbl.Apply(ctx, id, mut) // add to bigtable, apply mutates a row atomically
+	err := done(tbl.Apply(ctx, id, mut)) // add to bigtable, apply mutates a row atomically
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Post is saved to BigTable: %s\n", p.Message)
+	logFor(ctx).Debug("Post is saved to BigTable", "id", id)
 	return nil
 
 }
 
-// distance query
-func readFromES(query elastic.Query) ([]Post, error) {
-	client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false)) // connect
-	if err != nil {
-		return nil, err
+func deleteFromBigTable(ctx context.Context, id string) error {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+
+	ctx, done := trackBackend(ctx, BACKEND_BIGTABLE, "mutate", attribute.String("post.id", id))
+	tbl := btClient.Open("post")
+	mut := bigtable.NewMutation()
+	mut.DeleteRow() // deleting a missing row is not an error
+
+	if err := done(tbl.Apply(ctx, id, mut)); err != nil {
+		return err
 	}
+	logFor(ctx).Debug("Post is deleted from BigTable", "id", id)
+	return nil
+}
+
+// Search posts with query, sorted by sorters, one page at a time with search_after
+func readFromES(ctx context.Context, query elastic.Query, opts SearchOptions, sorters ...elastic.Sorter) (*PostPage, error) {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+	ctx, span := startSpan(ctx, "readFromES", attribute.Int("search.limit", opts.Limit), attribute.Bool("search.text", opts.Text != ""))
 
-	// 	query := elastic.NewGeoDistanceQuery("location") // GeoDistanceQuery filters documents that include only hits that exists within a specific distance from a geo point.
-	// 	query = query.Distance(ran).Lat(lat).Lon(lon) // set query 
-	// // use query as an input afterwards
-	searchResult, err := client.Search().
+	if opts.Text != "" { // full-text match on the message, the original query only filters
+		query = elastic.NewBoolQuery().
+			Must(elastic.NewMultiMatchQuery(opts.Text, "message", "tags")).
+			Filter(query)
+	}
+	search := esClient.Search().
 		Index(POST_INDEX).
 		Query(query).
-		Pretty(true). // format
-		Do(context.Background()) // do search
+		SortBy(sorters...).
+		Size(opts.Limit + 1). // one extra hit tells whether there is a next page
+		Pretty(true)          // format
+	if opts.Text != "" {
+		search = search.Highlight(elastic.NewHighlight().Encoder("html").Fields(elastic.NewHighlighterField("message"))) // <em> around matched words, the rest HTML escaped
+	}
+	if opts.After != nil {
+		search = search.SearchAfter(opts.After...) // continue after the last hit of the previous page
+	}
+	searchResult, err := search.Do(ctx) // do search
 	if err != nil {
-		return nil, err
+		return nil, endSpan(span, err)
 	}
 
 	// searchResult is of type SearchResult and returns hits, suggestions,
 	// and all kinds of other information from Elasticsearch.
-	fmt.Printf("Query took %d milliseconds\n", searchResult.TookInMillis)
-
-	// Each is a convenience function that iterates over hits in a search result.
-	// It makes sure you don't need to check for nil values in the response.
-	// However, it ignores errors in serialization. If you want full control
-	// over iterating the hits, see below.
-	var ptyp Post
-	var posts []Post
-	for _, item := range searchResult.Each(reflect.TypeOf(ptyp)) { // reflect allows a program to manipulate objects with arbitrary types
-		if p, ok := item.(Post); ok { // A type assertion provides access to an interface value's underlying concrete value. This statement asserts that the interface value i holds the concrete type T and assigns the underlying T value to the variable t.
-			posts = append(posts, p) // casting -> add
+	logFor(ctx).Debug("Query finished", "took_ms", searchResult.TookInMillis)
+	span.SetAttributes(attribute.Int64("es.took_ms", searchResult.TookInMillis), attribute.Int64("es.total_hits", searchResult.TotalHits()))
+
+	// Each() would drop the hit ids and sort values, so iterate over the hits ourselves.
+	// Like Each(), hits that cannot be decoded are skipped.
+	page := &PostPage{Total: searchResult.TotalHits()}
+	if searchResult.Hits == nil {
+		return page, endSpan(span, nil)
+	}
+	hits := searchResult.Hits.Hits
+	if len(hits) > opts.Limit {
+		hits = hits[:opts.Limit]
+		if page.NextCursor, err = encodeCursor(opts.Sort, hits[len(hits)-1].Sort); err != nil {
+			return nil, endSpan(span, err)
+		}
+	}
+	for _, hit := range hits {
+		if hit.Source == nil {
+			continue
 		}
+		var p Post
+		if err := json.Unmarshal(*hit.Source, &p); err != nil {
+			logFor(ctx).Warn("Failed to decode post", "id", hit.Id, "error", err)
+			continue
+		}
+		p.ID = hit.Id // older documents do not carry their id
+		p.Highlights = hit.Highlight["message"]
+		page.Posts = append(page.Posts, p)
 	}
 
-	return posts, nil
+	return page, endSpan(span, nil)
 }
 
-func saveToGCS(r io.Reader, bucketName, objectName string) (*storage.ObjectAttrs, error) {
-	ctx := context.Background() // more on context: https://blog.golang.org/context
-
-	// Creates a client.
-	client, err := storage.NewClient(ctx)
-	if err != nil {
-		return nil, err
-	}
+func saveToGCS(ctx context.Context, client *storage.Client, r io.Reader, bucketName, objectName, contentType string) error {
+	// no store_timeout, an upload takes as long as the client sends, ctx ends it if the client goes away
+	// the bucket is not looked up first, Ping already checks it for /readyz and a missing one fails the write
 
 	bucket := client.Bucket(bucketName) // make a bucket handle
-	if _, err := bucket.Attrs(ctx); err != nil { // retrieve a bucket's attributes
-		return nil, err
-	}
 
-	object := bucket.Object(objectName) // refer to objects using a handle, 
-	wc := object.NewWriter(ctx)  // wc implements io.Writer
-	if _, err = io.Copy(wc, r); err != nil { // write
-		return nil, err
+	object := bucket.Object(objectName)       // refer to objects using a handle,
+	wc := object.NewWriter(ctx)               // wc implements io.Writer
+	wc.ContentType = contentType              // served with it, otherwise GCS guesses from the bytes
+	if _, err := io.Copy(wc, r); err != nil { // write
+		return err
 	}
 	if err := wc.Close(); err != nil {
-		return nil, err
-	}
-
-	if err = object.ACL().Set(ctx, storage.AllUsers, storage.RoleReader); err != nil { // Access Control Lists, "allUsers", "READER" 
-		return nil, err
+		return err
 	}
 
-	attrs, err := object.Attrs(ctx) // return attributes
-	if err != nil {
-		return nil, err
+	if err := object.ACL().Set(ctx, storage.AllUsers, storage.RoleReader); err != nil { // Access Control Lists, "allUsers", "READER"
+		return err
 	}
 
-	fmt.Printf("Image is saved to GCS: %s\n", attrs.MediaLink)
-	return attrs, nil
+	logFor(ctx).Debug("Image is saved to GCS", "object", objectName)
+	return nil
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+)
+
+// setupMemory points the globals at the default config, fresh memory stores, a local media store in a
+// temporary directory and a static face scorer, restored when t ends
+func setupMemory(t *testing.T) *memoryPostStore {
+	t.Helper()
+	oldConfig, oldLogger, oldScorer := config, logger, faceScorer
+	oldPosts, oldUsers, oldTokens, oldMedia, oldLimiter, oldRing := postStore, userStore, tokenStore, mediaStore, rateLimiter, keyRing
+	t.Cleanup(func() {
+		config, logger, faceScorer = oldConfig, oldLogger, oldScorer
+		postStore, userStore, tokenStore, mediaStore, rateLimiter, keyRing = oldPosts, oldUsers, oldTokens, oldMedia, oldLimiter, oldRing
+	})
+
+	config = defaultConfig()
+	config.PostStore, config.UserStore, config.TokenStore = STORE_MEMORY, STORE_MEMORY, STORE_MEMORY
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	if err := setupRateLimits(); err != nil {
+		t.Fatal(err)
+	}
+	ring, err := newKeyRing(nil, "test-secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyRing = ring
+	store := newMemoryPostStore()
+	postStore, userStore, tokenStore = store, newMemoryUserStore(), newMemoryTokenStore()
+	mediaStore = &localMediaStore{dir: t.TempDir(), baseURL: "http://localhost:8080"}
+	faceScorer = &staticScorer{score: 0.75}
+	return store
+}
+
+// asUser adds what jwtMiddleware puts in the context for a valid token of username
+func asUser(r *http.Request, username string) *http.Request {
+	token := &jwt.Token{Claims: jwt.MapClaims{"username": username, "jti": "test"}, Valid: true}
+	return r.WithContext(context.WithValue(r.Context(), "user", token))
+}
+
+// decodeError reads the errorBody writeError sent
+func decodeError(t *testing.T, w *httptest.ResponseRecorder) errorBody {
+	t.Helper()
+	var body errorBody
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("error body %q: %v", w.Body.String(), err)
+	}
+	return body
+}
+
+func TestHandlerPost(t *testing.T) {
+	store := setupMemory(t)
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("lat", "37.78")
+	form.WriteField("lon", "-122.41")
+	form.WriteField("message", "hello #sf")
+	image, _ := form.CreateFormFile("image", "face.jpg")
+	image.Write(append([]byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x10}, "JFIF\x00"...))
+	form.Close()
+
+	r := httptest.NewRequest("POST", "/post", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	before := time.Now().UTC()
+	handlerPost(w, asUser(r, "alice"))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want 201: %s", w.Code, w.Body)
+	}
+
+	var p Post
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.ID == "" || p.User != "alice" || p.MimeType != "image/jpeg" || p.Type != "image" || p.Face != 0.75 {
+		t.Errorf("post = %+v, want an id, alice, image/jpeg and the face score", p)
+	}
+	if p.CreatedAt.Before(before.Add(-time.Second)) || p.CreatedAt.After(time.Now().Add(time.Second)) || !p.UpdatedAt.Equal(p.CreatedAt) {
+		t.Errorf("created_at = %v, updated_at = %v, want now", p.CreatedAt, p.UpdatedAt)
+	}
+	if saved, err := store.Get(context.Background(), p.ID); err != nil || !saved.CreatedAt.Equal(p.CreatedAt) {
+		t.Errorf("saved post = %+v, %v, want the returned one", saved, err)
+	}
+}
+
+func TestHandlerSearch(t *testing.T) {
+	store := setupMemory(t)
+	now := time.Now().UTC()
+	for id, p := range map[string]Post{
+		"near": {User: "alice", Message: "coffee at <b>noon</b>", Location: Location{Lat: 37.77, Lon: -122.42}, CreatedAt: now},
+		"far":  {User: "bob", Message: "coffee in paris", Location: Location{Lat: 48.85, Lon: 2.35}, CreatedAt: now},
+	} {
+		p := p
+		store.Save(context.Background(), &p, id)
+	}
+	badCursor := base64.RawURLEncoding.EncodeToString([]byte(`{"sort":"distance","after":["x",1]}`)) // values swapped
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		field  string // of the invalid_field error
+		ids    []string
+	}{
+		{"radius", "lat=37.78&lon=-122.41", http.StatusOK, "", []string{"near"}},
+		{"text", "lat=37.78&lon=-122.41&q=coffee&sort=relevance", http.StatusOK, "", []string{"near"}},
+		{"no lat", "lon=-122.41", http.StatusBadRequest, "lat", nil},
+		{"NaN lat", "lat=NaN&lon=-122.41", http.StatusBadRequest, "lat", nil},
+		{"range too large", "lat=37.78&lon=-122.41&range=5000km", http.StatusBadRequest, "range", nil},
+		{"relevance without q", "lat=37.78&lon=-122.41&sort=relevance", http.StatusBadRequest, "q", nil},
+		{"bad cursor", "lat=37.78&lon=-122.41&cursor=" + badCursor, http.StatusBadRequest, "cursor", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handlerSearch(w, httptest.NewRequest("GET", "/search?"+tt.query, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				if body := decodeError(t, w); body.Code != CODE_INVALID_FIELD || body.Field != tt.field {
+					t.Errorf("error = %+v, want invalid_field %s", body, tt.field)
+				}
+				return
+			}
+			var page PostPage
+			if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, p := range page.Posts {
+				ids = append(ids, p.ID)
+				for _, h := range p.Highlights {
+					if strings.Contains(h, "<b>") {
+						t.Errorf("highlight %q is not escaped", h)
+					}
+				}
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.ids, ",") {
+				t.Errorf("posts = %v, want %v", ids, tt.ids)
+			}
+		})
+	}
+}
+
+func TestHandlerUpdatePost(t *testing.T) {
+	store := setupMemory(t)
+	store.Save(context.Background(), &Post{User: "alice", Message: "hello", Location: Location{Lat: 1, Lon: 2}}, "p1")
+
+	tests := []struct {
+		name   string
+		user   string
+		body   string
+		status int
+		field  string
+	}{
+		{"message", "alice", `{"message":"hello #go"}`, http.StatusOK, ""},
+		{"location", "alice", `{"location":{"lat":10,"lon":20}}`, http.StatusOK, ""},
+		{"lat out of range", "alice", `{"location":{"lat":999}}`, http.StatusBadRequest, "location"},
+		{"lon out of range", "alice", `{"location":{"lat":0,"lon":-181}}`, http.StatusBadRequest, "location"},
+		{"not json", "alice", `{`, http.StatusBadRequest, "body"},
+		{"other user", "bob", `{"message":"mine now"}`, http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("PUT", "/post/p1", strings.NewReader(tt.body))
+			r = mux.SetURLVars(asUser(r, tt.user), map[string]string{"id": "p1"})
+			w := httptest.NewRecorder()
+			handlerUpdatePost(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.field != "" {
+				if body := decodeError(t, w); body.Field != tt.field {
+					t.Errorf("field = %q, want %q", body.Field, tt.field)
+				}
+			}
+		})
+	}
+
+	p, err := store.Get(context.Background(), "p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Message != "hello #go" || p.Location != (Location{Lat: 10, Lon: 20}) || len(p.Tags) != 1 || p.Tags[0] != "go" {
+		t.Errorf("saved post = %+v", p)
+	}
+}
+
+func TestHandlerCluster(t *testing.T) {
+	store := setupMemory(t)
+	store.Save(context.Background(), &Post{User: "alice", Face: 0.99}, "face")
+	store.Save(context.Background(), &Post{User: "alice", Face: 0.5}, "noface")
+
+	tests := []struct {
+		query  string
+		status int
+		posts  int
+	}{
+		{"term=face", http.StatusOK, 1},
+		{"", http.StatusBadRequest, 0},
+		{"term=user", http.StatusBadRequest, 0},
+		{"term=location.lat", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handlerCluster(w, httptest.NewRequest("GET", "/cluster?"+tt.query, nil))
+		if w.Code != tt.status {
+			t.Errorf("%q: status = %d, want %d: %s", tt.query, w.Code, tt.status, w.Body)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			if body := decodeError(t, w); body.Field != "term" {
+				t.Errorf("%q: field = %q, want term", tt.query, body.Field)
+			}
+			continue
+		}
+		var page PostPage
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Posts) != tt.posts {
+			t.Errorf("%q: %d posts, want %d", tt.query, len(page.Posts), tt.posts)
+		}
+	}
+}
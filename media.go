@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	MEDIA_GCS   = "gcs"
+	MEDIA_LOCAL = "local"
+)
+
+var errMediaNotFound = fmt.Errorf("Media %w", ErrNotFound)
+
+// MediaStore saves uploaded images/videos and tells clients where to fetch them
+type MediaStore interface {
+	Put(ctx context.Context, r io.Reader, id, contentType string) error // write the file content under id
+	Get(ctx context.Context, id string) (io.ReadCloser, error)          // read it back, errMediaNotFound if missing
+	Delete(ctx context.Context, id string) error                        // remove it
+	PublicURL(id string) string                                         // url stored in Post.Url
+	Ping(ctx context.Context) error                                     // nil if the store can be used, for /readyz
+}
+
+var mediaStore MediaStore // selected at startup in main
+
+// newMediaStore picks the backend by name, dir and baseURL are only used by the local backend
+func newMediaStore(backend, dir, baseURL string) (MediaStore, error) {
+	switch backend {
+	case MEDIA_GCS:
+		client, err := storage.NewClient(context.Background()) // finds the credentials, connects on first use
+		if err != nil {
+			return nil, err
+		}
+		return &gcsMediaStore{client: client, bucket: config.BucketName}, nil
+	case MEDIA_LOCAL:
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		return &localMediaStore{dir: dir, baseURL: strings.TrimRight(baseURL, "/")}, nil
+	default:
+		return nil, fmt.Errorf("unknown media store %q", backend)
+	}
+}
+
+// gcsMediaStore keeps files in a public-read Google Cloud Storage bucket
+type gcsMediaStore struct {
+	client *storage.Client // shared by all requests, closed by closeClients
+	bucket string
+}
+
+func (s *gcsMediaStore) Put(ctx context.Context, r io.Reader, id, contentType string) error {
+	ctx, done := trackBackend(ctx, MEDIA_GCS, "upload", attribute.String("gcs.bucket", s.bucket), attribute.String("gcs.object", id))
+	cr := &countingReader{r: r}
+	err := saveToGCS(ctx, s.client, cr, s.bucket, id, contentType)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("media.bytes", cr.n))
+	if err == nil {
+		uploadBytes.WithLabelValues(MEDIA_GCS).Observe(float64(cr.n))
+	}
+	return upstream(MEDIA_GCS, done(err))
+}
+
+func (s *gcsMediaStore) Get(ctx context.Context, id string) (io.ReadCloser, error) { // no store_timeout, the caller streams the file
+	ctx, done := trackBackend(ctx, MEDIA_GCS, "download", attribute.String("gcs.object", id)) // until the object is opened, not the whole stream
+	rc, err := s.client.Bucket(s.bucket).Object(id).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		done(nil)
+		return nil, errMediaNotFound
+	}
+	return rc, upstream(MEDIA_GCS, done(err))
+}
+
+func (s *gcsMediaStore) Delete(ctx context.Context, id string) error {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+
+	ctx, done := trackBackend(ctx, MEDIA_GCS, "delete", attribute.String("gcs.object", id))
+	err := s.client.Bucket(s.bucket).Object(id).Delete(ctx)
+	if err == storage.ErrObjectNotExist {
+		done(nil)
+		return errMediaNotFound
+	}
+	return upstream(MEDIA_GCS, done(err))
+}
+
+func (s *gcsMediaStore) Ping(ctx context.Context) error {
+	_, err := s.client.Bucket(s.bucket).Attrs(ctx) // the bucket exists and our credentials can see it
+	return err
+}
+
+func (s *gcsMediaStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *gcsMediaStore) PublicURL(id string) string {
+	return "https://storage.googleapis.com/" + s.bucket + "/" + id // objects are readable by allUsers
+}
+
+// localMediaStore keeps files on disk and serves them through GET /media/{id}
+type localMediaStore struct {
+	dir     string
+	baseURL string // e.g. http://localhost:8080
+}
+
+// path maps id to a file inside dir, rejecting anything that could escape it
+func (s *localMediaStore) path(id string) (string, error) {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+		return "", fmt.Errorf("invalid media id %q", id)
+	}
+	return filepath.Join(s.dir, id), nil
+}
+
+func (s *localMediaStore) Put(ctx context.Context, r io.Reader, id, contentType string) error { // handlerMedia sniffs the type again
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		os.Remove(path) // do not leave half written files around
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	uploadBytes.WithLabelValues(MEDIA_LOCAL).Observe(float64(n))
+
+	logFor(ctx).Debug("Media is saved to disk", "path", path)
+	return nil
+}
+
+func (s *localMediaStore) Get(ctx context.Context, id string) (io.ReadCloser, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, errMediaNotFound
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, errMediaNotFound
+	}
+	return f, err
+}
+
+func (s *localMediaStore) Delete(ctx context.Context, id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return errMediaNotFound
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return errMediaNotFound
+	}
+	return err
+}
+
+func (s *localMediaStore) Ping(ctx context.Context) error {
+	f, err := ioutil.TempFile(s.dir, ".ping") // the directory exists and is writable
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func (s *localMediaStore) PublicURL(id string) string {
+	return s.baseURL + "/media/" + id
+}
+
+func handlerMedia(w http.ResponseWriter, r *http.Request) {
+	logFor(r.Context()).Debug("Received one media request")
+
+	id := mux.Vars(r)["id"]
+	rc, err := mediaStore.Get(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err, "Failed to read media") // 404 for errMediaNotFound
+		return
+	}
+	defer rc.Close()
+
+	br := bufio.NewReader(rc)
+	head, _ := br.Peek(512) // content type is sniffed from the first 512 bytes
+	w.Header().Set("Content-Type", sniffMediaType(head))
+	if _, err := io.Copy(w, br); err != nil {
+		logFor(r.Context()).Warn("Failed to send media", "error", err) // usually the client went away
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestLocalMediaStorePath(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "media")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(root, "secret"), []byte("outside"), 0644)
+	setupMemory(t)
+	mediaStore = &localMediaStore{dir: dir} // restored by setupMemory
+
+	tests := []struct {
+		id string
+		ok bool
+	}{
+		{"3f2a9c1e-post", true},
+		{"..x", true}, // a name, not a parent
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../secret", false},
+		{"../x", false},
+		{"a/../../b", false},
+		{"a/b", false},
+		{`..\secret`, false},
+		{"/etc/passwd", false},
+		{filepath.Join(root, "secret"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			path, err := mediaStore.(*localMediaStore).path(tt.id)
+			if (err == nil) != tt.ok {
+				t.Fatalf("path(%q) = %q, %v, want ok %v", tt.id, path, err, tt.ok)
+			}
+			if err == nil && filepath.Dir(path) != dir {
+				t.Errorf("path(%q) = %q, outside %s", tt.id, path, dir)
+			}
+
+			// the handler must not read anything outside the directory either
+			r := mux.SetURLVars(httptest.NewRequest("GET", "/media/x", nil), map[string]string{"id": tt.id})
+			w := httptest.NewRecorder()
+			handlerMedia(w, r)
+			if w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "outside") {
+				t.Errorf("GET /media/%s = %d %q, want 404", tt.id, w.Code, w.Body)
+			}
+		})
+	}
+}
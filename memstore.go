@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const EARTH_RADIUS = 6371008.8 // mean earth radius in meters, same as Elasticsearch uses
+
+// distance units accepted by Elasticsearch, in meters
+var distanceUnits = map[string]float64{
+	"mm":  0.001,
+	"cm":  0.01,
+	"m":   1,
+	"km":  1000,
+	"in":  0.0254,
+	"ft":  0.3048,
+	"yd":  0.9144,
+	"mi":  1609.344,
+	"nmi": 1852,
+	"NM":  1852,
+}
+
+// memoryPostStore keeps posts in a map, for local runs and tests without Elasticsearch
+type memoryPostStore struct {
+	mu    sync.RWMutex
+	posts map[string]Post // id -> post
+}
+
+func newMemoryPostStore() *memoryPostStore {
+	return &memoryPostStore{posts: make(map[string]Post)}
+}
+
+func (s *memoryPostStore) EnsureSchema(ctx context.Context) error {
+	return nil // nothing to create
+}
+
+func (s *memoryPostStore) Save(ctx context.Context, post *Post, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, exists := s.posts[id]
+	if post.Version != nil && (!exists || *old.Version != *post.Version) {
+		return errPostConflict
+	}
+	saved := *post
+	saved.ID = id
+	saved.Version = &PostVersion{PrimaryTerm: 1} // seq_no counts the saves of id like in Elasticsearch
+	if exists {
+		saved.Version.SeqNo = old.Version.SeqNo + 1
+	}
+	s.posts[id] = saved
+	post.Version = saved.Version
+	logFor(ctx).Debug("Post is saved to memory", "id", id)
+	return nil
+}
+
+func (s *memoryPostStore) Get(ctx context.Context, id string) (*Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.posts[id]
+	if !ok {
+		return nil, errPostNotFound
+	}
+	return &p, nil
+}
+
+func (s *memoryPostStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.posts[id]; !ok {
+		return errPostNotFound
+	}
+	delete(s.posts, id)
+	return nil
+}
+
+func (s *memoryPostStore) GeoSearch(ctx context.Context, lat, lon float64, distance string, opts SearchOptions) (*PostPage, error) {
+	meters, err := parseDistance(distance)
+	if err != nil {
+		return nil, err
+	}
+	return s.search(func(p Post) bool {
+		return haversine(lat, lon, p.Location.Lat, p.Location.Lon) <= meters
+	}, func(p Post) float64 {
+		return haversine(lat, lon, p.Location.Lat, p.Location.Lon) / 1000
+	}, opts)
+}
+
+func (s *memoryPostStore) BoxSearch(ctx context.Context, box BoundingBox, opts SearchOptions) (*PostPage, error) {
+	return s.search(func(p Post) bool {
+		return box.Contains(p.Location)
+	}, nil, opts)
+}
+
+func (s *memoryPostStore) PolygonSearch(ctx context.Context, ring []Location, opts SearchOptions) (*PostPage, error) {
+	return s.search(func(p Post) bool {
+		return polygonContains(ring, p.Location)
+	}, nil, opts)
+}
+
+// Heatmap groups the matching posts by geohash, the centroid is the mean of their locations like geo_centroid
+func (s *memoryPostStore) Heatmap(ctx context.Context, box BoundingBox, precision int, filter HeatmapFilter) ([]HeatCell, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	byHash := map[string]*HeatCell{}
+	for _, p := range s.posts {
+		if !box.Contains(p.Location) || (filter.Type != "" && p.Type != filter.Type) || p.Face < filter.MinFace {
+			continue
+		}
+		hash := encodeGeohash(p.Location, precision)
+		cell, ok := byHash[hash]
+		if !ok {
+			cell = &HeatCell{Geohash: hash}
+			byHash[hash] = cell
+		}
+		cell.Count++
+		cell.Location.Lat += p.Location.Lat // summed here, divided below
+		cell.Location.Lon += p.Location.Lon
+	}
+
+	var cells []HeatCell
+	for _, cell := range byHash {
+		cell.Location.Lat /= float64(cell.Count)
+		cell.Location.Lon /= float64(cell.Count)
+		cells = append(cells, *cell)
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].Count != cells[j].Count {
+			return cells[i].Count > cells[j].Count
+		}
+		return cells[i].Geohash < cells[j].Geohash
+	})
+	if len(cells) > MAX_HEATMAP_CELLS {
+		cells = cells[:MAX_HEATMAP_CELLS]
+	}
+	return cells, nil
+}
+
+func (s *memoryPostStore) RangeSearch(ctx context.Context, field string, gte float64, opts SearchOptions) (*PostPage, error) {
+	value, err := numericField(field)
+	if err != nil {
+		return nil, err
+	}
+	return s.search(func(p Post) bool {
+		return value(p) >= gte
+	}, nil, opts)
+}
+
+func (s *memoryPostStore) TagSearch(ctx context.Context, tag string, opts SearchOptions) (*PostPage, error) {
+	return s.search(func(p Post) bool {
+		for _, t := range p.Tags {
+			if t == tag {
+				return true
+			}
+		}
+		return false
+	}, nil, opts)
+}
+
+// search returns one page of the posts matching keep, ordered like esSorters: sort key, then id.
+// distance gives the sort key of SORT_DISTANCE, in km like Elasticsearch returns it.
+func (s *memoryPostStore) search(keep func(Post) bool, distance func(Post) float64, opts SearchOptions) (*PostPage, error) {
+	terms := textTerms(opts.Text)
+	var key func(Post) float64
+	desc := true
+	switch opts.Sort {
+	case SORT_DISTANCE:
+		if distance == nil {
+			return nil, fmt.Errorf("sort %q needs a point", opts.Sort)
+		}
+		key, desc = distance, false
+	case SORT_NEWEST:
+		key = func(p Post) float64 { return float64(p.CreatedAt.UnixNano() / int64(time.Millisecond)) }
+	case SORT_RELEVANCE: // number of q words found, a rough stand-in for the Elasticsearch score
+		key = func(p Post) float64 { return float64(matchTerms(p, terms)) }
+	default: // SORT_FACE
+		key = func(p Post) float64 { return p.Face }
+	}
+	// before reports whether a sorts before b
+	before := func(aKey float64, aID string, bKey float64, bID string) bool {
+		if aKey != bKey {
+			return (aKey < bKey) != desc
+		}
+		return aID < bID
+	}
+
+	s.mu.RLock()
+	var posts []Post
+	for _, p := range s.posts {
+		if keep(p) && (len(terms) == 0 || matchTerms(p, terms) > 0) {
+			if len(terms) > 0 {
+				p.Highlights = highlight(p.Message, terms)
+			}
+			posts = append(posts, p)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(posts, func(i, j int) bool {
+		return before(key(posts[i]), posts[i].ID, key(posts[j]), posts[j].ID)
+	})
+	page := &PostPage{Total: int64(len(posts))}
+
+	if opts.After != nil { // skip up to and including the cursor post
+		if len(opts.After) != 2 {
+			return nil, errors.New("invalid cursor")
+		}
+		afterNum, ok1 := opts.After[0].(json.Number)
+		afterID, ok2 := opts.After[1].(string)
+		if !ok1 || !ok2 {
+			return nil, errors.New("invalid cursor")
+		}
+		afterKey, err := afterNum.Float64()
+		if err != nil {
+			return nil, errors.New("invalid cursor")
+		}
+		i := sort.Search(len(posts), func(i int) bool {
+			return before(afterKey, afterID, key(posts[i]), posts[i].ID)
+		})
+		posts = posts[i:]
+	}
+
+	if len(posts) > opts.Limit {
+		posts = posts[:opts.Limit]
+		last := posts[len(posts)-1]
+		next, err := encodeCursor(opts.Sort, []interface{}{key(last), last.ID})
+		if err != nil {
+			return nil, err
+		}
+		page.NextCursor = next
+	}
+	page.Posts = posts
+	return page, nil
+}
+
+var wordPattern = regexp.MustCompile(`[\p{L}\p{N}_]+`)
+
+// textTerms splits a full-text query into lowercase words
+func textTerms(text string) map[string]bool {
+	terms := map[string]bool{}
+	for _, word := range wordPattern.FindAllString(strings.ToLower(text), -1) {
+		terms[word] = true
+	}
+	return terms
+}
+
+// matchTerms counts the query words found in the message or tags, like a multi_match with the or operator
+func matchTerms(p Post, terms map[string]bool) int {
+	found := textTerms(p.Message)
+	for _, tag := range p.Tags {
+		found[tag] = true
+	}
+	n := 0
+	for term := range terms {
+		if found[term] {
+			n++
+		}
+	}
+	return n
+}
+
+// highlight wraps the matched words of message in <em> and escapes the rest, like the Elasticsearch highlighter
+// with the html encoder. Clients render it as HTML, so no text of the message may pass unescaped.
+func highlight(message string, terms map[string]bool) []string {
+	var b strings.Builder
+	last, matched := 0, false
+	for _, loc := range wordPattern.FindAllStringIndex(message, -1) {
+		if terms[strings.ToLower(message[loc[0]:loc[1]])] {
+			b.WriteString(html.EscapeString(message[last:loc[0]]))
+			b.WriteString("<em>" + html.EscapeString(message[loc[0]:loc[1]]) + "</em>")
+			last, matched = loc[1], true
+		}
+	}
+	if !matched {
+		return nil
+	}
+	b.WriteString(html.EscapeString(message[last:]))
+	return []string{b.String()}
+}
+
+// numericField maps an index field name to a getter on Post
+func numericField(field string) (func(Post) float64, error) {
+	switch field {
+	case "face":
+		return func(p Post) float64 { return p.Face }, nil
+	case "location.lat":
+		return func(p Post) float64 { return p.Location.Lat }, nil
+	case "location.lon":
+		return func(p Post) float64 { return p.Location.Lon }, nil
+	default:
+		return nil, fmt.Errorf("field %q is not a numeric post field", field)
+	}
+}
+
+// parseDistance turns an Elasticsearch distance like "200km" into meters, no unit means meters
+func parseDistance(distance string) (float64, error) {
+	distance = strings.TrimSpace(distance)
+	i := len(distance)
+	for i > 0 && !strings.ContainsAny(distance[i-1:i], "0123456789.") {
+		i--
+	}
+	unit := distance[i:]
+	multiplier := 1.0
+	if unit != "" {
+		m, ok := distanceUnits[unit]
+		if !ok {
+			return 0, fmt.Errorf("unknown distance unit in %q", distance)
+		}
+		multiplier = m
+	}
+	value, err := strconv.ParseFloat(distance[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid distance %q", distance)
+	}
+	return value * multiplier, nil
+}
+
+// haversine returns the great-circle distance in meters between two points
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := func(d float64) float64 { return d * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EARTH_RADIUS * math.Asin(math.Sqrt(math.Min(1, a)))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryPostStorePages(t *testing.T) {
+	setupMemory(t)
+	ctx := context.Background()
+	store := newMemoryPostStore()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 7; i++ {
+		id := fmt.Sprintf("p%d", i)
+		created := start.Add(time.Duration(i/2) * time.Hour) // pairs share created_at, the id breaks the tie
+		store.Save(ctx, &Post{User: "alice", Face: float64(i%3) / 2, CreatedAt: created}, id)
+	}
+	newest := []string{"p6", "p4", "p5", "p2", "p3", "p0", "p1"}
+
+	for _, limit := range []int{1, 2, 3, 7, 10} {
+		t.Run(fmt.Sprintf("limit %d", limit), func(t *testing.T) {
+			var got []string
+			opts := SearchOptions{Sort: SORT_NEWEST, Limit: limit}
+			for pages := 0; ; pages++ {
+				if pages > len(newest) {
+					t.Fatal("cursor never ends")
+				}
+				page, err := store.RangeSearch(ctx, "face", 0, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if page.Total != int64(len(newest)) {
+					t.Errorf("total = %d, want %d", page.Total, len(newest))
+				}
+				if len(page.Posts) > limit {
+					t.Fatalf("%d posts on a page of %d", len(page.Posts), limit)
+				}
+				for _, p := range page.Posts {
+					got = append(got, p.ID)
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				c, err := decodeCursor(page.NextCursor)
+				if err != nil {
+					t.Fatal(err)
+				}
+				opts.After = c.After
+			}
+			if strings.Join(got, ",") != strings.Join(newest, ",") {
+				t.Errorf("pages = %v, want %v", got, newest)
+			}
+		})
+	}
+
+	// a post saved between pages shows up only if it sorts after the cursor
+	page, _ := store.RangeSearch(ctx, "face", 0, SearchOptions{Sort: SORT_NEWEST, Limit: 2})
+	store.Save(ctx, &Post{User: "alice", CreatedAt: start.Add(time.Minute)}, "late")
+	c, _ := decodeCursor(page.NextCursor)
+	rest, err := store.RangeSearch(ctx, "face", 0, SearchOptions{Sort: SORT_NEWEST, Limit: 10, After: c.After})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, p := range rest.Posts {
+		ids = append(ids, p.ID)
+	}
+	if want := "p5,p2,p3,late,p0,p1"; strings.Join(ids, ",") != want {
+		t.Errorf("after the first page = %v, want %s", ids, want)
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	terms := textTerms("coffee")
+	tests := []struct {
+		message string
+		want    []string
+	}{
+		{"Coffee time", []string{"<em>Coffee</em> time"}},
+		{"<img src=x onerror=alert(1)> coffee & cake", []string{"&lt;img src=x onerror=alert(1)&gt; <em>coffee</em> &amp; cake"}},
+		{"tea only", nil},
+	}
+	for _, tt := range tests {
+		got := highlight(tt.message, terms)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("highlight(%q) = %q, want %q", tt.message, got, tt.want)
+		}
+	}
+}
+
+func TestCursorKeepsLongSortValues(t *testing.T) {
+	// Elasticsearch sorts a missing long as Long.MIN_VALUE, which a float64 rounds out of range
+	next, err := encodeCursor(SORT_NEWEST, []interface{}{json.Number("-9223372036854775808"), "p1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := decodeCursor(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, _ := json.Marshal(c.After)
+	if want := `[-9223372036854775808,"p1"]`; string(js) != want {
+		t.Errorf("search_after = %s, want %s", js, want)
+	}
+}
+
+func TestMemoryPostStoreSaveConflict(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryPostStore()
+	store.Save(ctx, &Post{User: "alice", Message: "hello"}, "p1")
+
+	first, _ := store.Get(ctx, "p1")
+	second, _ := store.Get(ctx, "p1")
+	first.Message = "first edit"
+	if err := store.Save(ctx, first, "p1"); err != nil {
+		t.Fatal(err)
+	}
+	second.Message = "second edit"
+	err := store.Save(ctx, second, "p1")
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("save of a stale post = %v, want a conflict", err)
+	}
+	if status, _ := errorStatus(upstream(STORE_ELASTICSEARCH, err)); status != http.StatusConflict {
+		t.Errorf("status = %d, want 409", status)
+	}
+	if p, _ := store.Get(ctx, "p1"); p.Message != "first edit" {
+		t.Errorf("message = %q, the first edit was lost", p.Message)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+const (
+	BACKEND_BIGTABLE = "bigtable"
+	RESULT_OK        = "ok"
+	RESULT_ERROR     = "error"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "around_http_requests_total",
+		Help: "HTTP requests by route template, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "around_http_request_duration_seconds",
+		Help:    "HTTP request latency by route template, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	backendCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "around_backend_calls_total",
+		Help: "Calls to Elasticsearch, GCS, BigTable and the face scorer by operation and result.",
+	}, []string{"backend", "operation", "result"})
+
+	backendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "around_backend_call_duration_seconds",
+		Help:    "Latency of calls to Elasticsearch, GCS, BigTable and the face scorer.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend", "operation"})
+
+	uploadBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "around_media_upload_bytes",
+		Help:    "Size of uploaded images and videos by media store.",
+		Buckets: prometheus.ExponentialBuckets(16*1024, 4, 8), // 16KiB to 256MiB
+	}, []string{"backend"})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpDuration, backendCalls, backendDuration, uploadBytes)
+}
+
+// trackBackend starts timing one backend call and a span for it, the span is in the returned ctx.
+// The returned func records the outcome, ends the span and passes err through.
+func trackBackend(ctx context.Context, backend, operation string, attrs ...attribute.KeyValue) (context.Context, func(err error) error) {
+	start := time.Now()
+	ctx, span := startSpan(ctx, backend+" "+operation, attrs...)
+	return ctx, func(err error) error {
+		result := RESULT_OK
+		if err != nil {
+			result = RESULT_ERROR
+		}
+		backendCalls.WithLabelValues(backend, operation, result).Inc()
+		backendDuration.WithLabelValues(backend, operation).Observe(time.Since(start).Seconds())
+		return endSpan(span, err)
+	}
+}
+
+// countingReader counts the bytes read through it, for upload sizes
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// statusRecorder remembers the status code a handler wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// metricsMiddleware wraps the router and counts and times every request, 404 and 405 included. The route template
+// recordRoute found, not the path, is the label so /post/{id} stays one series, requests no route matched are "unmatched".
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry, r := withAccessEntry(r)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		status := strconv.Itoa(rec.status)
+		httpRequests.WithLabelValues(entry.route, r.Method, status).Inc()
+		httpDuration.WithLabelValues(entry.route, r.Method, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// esTransport times and traces every request the shared Elasticsearch client sends, whichever store or helper made it.
+// It retries esRetryStatus answers itself with backoff and returns the last one once it gives up. Surfaced as
+// transport errors they would make the client mark the node dead and fail every other call until a health check.
+// Retries are requests of their own.
+type esTransport struct {
+	next    http.RoundTripper
+	backoff elastic.Backoff // nil sends every request once
+}
+
+func (t *esTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte // kept to send it again, the client does not set GetBody
+	if req.Body != nil && t.backoff != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for retry := 1; ; retry++ {
+		resp, err := t.send(req, body)
+		if err != nil || t.backoff == nil || !esRetryStatus[resp.StatusCode] {
+			return resp, err
+		}
+		wait, ok := t.backoff.Next(retry)
+		if !ok {
+			return resp, nil // the client reads the status as an elastic.Error, the node stays alive
+		}
+		resp.Body.Close()
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done(): // the caller gave up, another try cannot finish in time
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// send makes one attempt of req, body replaces the request body when it is not nil
+func (t *esTransport) send(req *http.Request, body []byte) (*http.Response, error) {
+	ctx, done := trackBackend(req.Context(), STORE_ELASTICSEARCH, esOperation(req), attribute.String("http.request.method", req.Method))
+	req = req.Clone(ctx) // a RoundTripper must not change the caller's request
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	injectTrace(ctx, req.Header)
+
+	resp, err := t.next.RoundTrip(req)
+	if err == nil {
+		trace.SpanFromContext(ctx).SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	}
+	if err == nil && (resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests) {
+		done(&httpStatusError{resp.StatusCode}) // 404 of a get is an answer, not a failure
+	} else {
+		done(err)
+	}
+	return resp, err
+}
+
+// httpStatusError is a failed response, used to mark a call as an error
+type httpStatusError struct {
+	status int
+}
+
+func (e *httpStatusError) Error() string {
+	return http.StatusText(e.status)
+}
+
+// esEndpoints are the Elasticsearch endpoints that name an operation label. Document ids are usernames and can
+// start with '_' too, only a fixed set keeps the label values bounded.
+var esEndpoints = map[string]bool{
+	"_search": true, "_count": true, "_scroll": true, "_doc": true, "_create": true, "_update": true, "_bulk": true,
+	"_reindex": true, "_update_by_query": true, "_delete_by_query": true, "_alias": true, "_aliases": true,
+	"_settings": true, "_mapping": true, "_refresh": true, "_cluster": true,
+}
+
+// esOperation names an Elasticsearch request by its endpoint: search, update, reindex, ... or get/index/delete for
+// documents, "other" for a path with an unknown '_' segment
+func esOperation(req *http.Request) string {
+	unknown := false
+	for _, part := range strings.Split(req.URL.Path, "/") {
+		if esEndpoints[part] {
+			return strings.TrimPrefix(part, "_")
+		}
+		unknown = unknown || strings.HasPrefix(part, "_")
+	}
+	if unknown {
+		return "other"
+	}
+	switch req.Method {
+	case "GET", "HEAD":
+		return "get"
+	case "DELETE":
+		return "delete"
+	default:
+		return "index"
+	}
+}
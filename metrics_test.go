@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	r := mux.NewRouter()
+	r.Handle("/post/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).Methods("GET")
+	r.Use(recordRoute)
+	handler := metricsMiddleware(r)
+
+	tests := []struct {
+		method, path, route, status string
+	}{
+		{"GET", "/post/p1", "/post/{id}", "200"},
+		{"GET", "/nowhere", "unmatched", "404"},
+		{"DELETE", "/post/p1", "unmatched", "405"},
+	}
+	for _, tt := range tests {
+		before := testutil.ToFloat64(httpRequests.WithLabelValues(tt.route, tt.method, tt.status))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.path, nil))
+		if got := testutil.ToFloat64(httpRequests.WithLabelValues(tt.route, tt.method, tt.status)) - before; got != 1 {
+			t.Errorf("%s %s counted %v times as %s %s, want once", tt.method, tt.path, got, tt.route, tt.status)
+		}
+	}
+}
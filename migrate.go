@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+// indexSpec is the wanted version of an index. Clients only use Alias, the data lives in <alias>_v<version>.
+// To change a mapping, bump Version and edit Body, then run "around migrate" before starting the new build. It
+// reindexes into the new index and flips the alias, servers refuse to start on an older version.
+type indexSpec struct {
+	Alias   string
+	Version int
+	Body    string // settings and mappings of the new index
+	Script  string // optional painless run on each document copied from the previous version
+}
+
+var indexSpecs = []indexSpec{
+	{
+		Alias:   POST_INDEX,
+		Version: 3, // 2 adds mime_type, 3 fills id, created_at and updated_at in posts saved before they were stored
+		Body: `{
+            "settings": {
+                "analysis": {
+                    "analyzer": {
+                        "message_analyzer": {
+                            "type": "custom",
+                            "tokenizer": "standard",
+                            "filter": ["lowercase", "asciifolding"]
+                        }
+                    }
+                }
+            },
+            "mappings": {
+                "post": {
+                    "dynamic": false,
+                    "properties": {
+                        "id":         {"type": "keyword"},
+                        "user":       {"type": "keyword"},
+                        "message":    {"type": "text", "analyzer": "message_analyzer"},
+                        "location":   {"type": "geo_point"},
+                        "url":        {"type": "keyword", "index": false},
+                        "type":       {"type": "keyword"},
+                        "mime_type":  {"type": "keyword"},
+                        "face":       {"type": "float"},
+                        "tags":       {"type": "keyword"},
+                        "created_at": {"type": "date"},
+                        "updated_at": {"type": "date"}
+                    }
+                }
+            }
+        }`,
+		// id is the search_after tie-breaker and every sort or cursor on newest reads created_at, a string because Post decodes dates as RFC 3339
+		Script: "if (ctx._source.id == null) { ctx._source.id = ctx._id } " +
+			"if (ctx._source.created_at == null) { ctx._source.created_at = '1970-01-01T00:00:00Z' } " +
+			"if (ctx._source.updated_at == null) { ctx._source.updated_at = '1970-01-01T00:00:00Z' }",
+	},
+	{
+		Alias:   USER_INDEX,
+		Version: 1,
+		Body: `{
+            "mappings": {
+                "user": {
+                    "dynamic": false,
+                    "properties": {
+                        "username": {"type": "keyword"},
+                        "password": {"type": "keyword", "index": false},
+                        "age":      {"type": "integer"},
+                        "gender":   {"type": "keyword"}
+                    }
+                }
+            }
+        }`,
+	},
+}
+
+// MIGRATE_BATCH is how many ids the migration compares per request when it looks for deleted documents
+const MIGRATE_BATCH = 1000
+
+// runMigrate is the migrate command, it brings the indices of the stores kept in Elasticsearch to their version
+func runMigrate(ctx context.Context) error {
+	client, err := connectES(config.ESURL)
+	if err != nil {
+		return err
+	}
+	defer client.Stop()
+
+	stores := map[string]string{POST_INDEX: config.PostStore, USER_INDEX: config.UserStore}
+	for _, spec := range indexSpecs {
+		if stores[spec.Alias] != STORE_ELASTICSEARCH {
+			continue
+		}
+		if err := migrateIndex(ctx, client, spec); err != nil {
+			return fmt.Errorf("migrate %s: %v", spec.Alias, err)
+		}
+	}
+	return nil
+}
+
+// ensureIndex creates the index behind alias on a fresh cluster. Servers never migrate, an older version is an
+// error until the migrate command has run, a newer one is left alone for a rollback.
+func ensureIndex(ctx context.Context, client *elastic.Client, alias string) error {
+	for _, spec := range indexSpecs {
+		if spec.Alias != alias {
+			continue
+		}
+		current, _, err := aliasTarget(ctx, client, alias)
+		if err != nil {
+			return err
+		}
+		switch v := indexVersion(alias, current); {
+		case current == "":
+			return createIndex(ctx, client, spec)
+		case v < spec.Version:
+			return fmt.Errorf("index %s is %s but this build needs version %d, run the migrate command first", alias, current, spec.Version)
+		case v > spec.Version:
+			logFor(ctx).Warn("Index is newer than this build", "alias", alias, "version", v, "known_version", spec.Version)
+		}
+		return nil
+	}
+	return fmt.Errorf("no index spec for %s", alias)
+}
+
+// createIndex creates the index of spec and points the alias at it. Servers starting together on a fresh
+// cluster all get here, so an index that is already there is fine and adding the alias again changes nothing.
+func createIndex(ctx context.Context, client *elastic.Client, spec indexSpec) error {
+	target := fmt.Sprintf("%s_v%d", spec.Alias, spec.Version)
+	_, err := client.CreateIndex(target).Body(spec.Body).Do(ctx)
+	if err != nil && !indexAlreadyExists(err) {
+		return err
+	}
+	if err == nil {
+		logFor(ctx).Info("Created index", "index", target)
+	}
+	_, err = client.Alias().Action(elastic.NewAliasAddAction(spec.Alias).Index(target)).Do(ctx)
+	return err
+}
+
+// migrateIndex creates <alias>_v<version>, copies the old documents into it and points the alias at it.
+// The first copy runs while the service keeps writing. Documents keep their version, so the catch up afterwards
+// only copies what was written meanwhile, and then drops what was deleted meanwhile. Only the catch up runs with
+// the old index write blocked, writes to the alias fail for that long, reads keep working.
+// Creating the new index is the lock, a second migration started meanwhile fails instead of copying along. A
+// failed migration drops the new index again so it can simply be rerun.
+// The old versioned index is kept read-only for rollback. A pre-alias index named like the alias is removed in
+// the same atomic call that adds the alias, since both cannot share a name.
+func migrateIndex(ctx context.Context, client *elastic.Client, spec indexSpec) (err error) {
+	target := fmt.Sprintf("%s_v%d", spec.Alias, spec.Version)
+
+	current, legacy, err := aliasTarget(ctx, client, spec.Alias)
+	if err != nil {
+		return err
+	}
+	if current == target {
+		return nil // up to date
+	}
+	if v := indexVersion(spec.Alias, current); v > spec.Version {
+		logFor(ctx).Warn("Index is newer than this build, leaving it alone", "alias", spec.Alias, "version", v, "known_version", spec.Version)
+		return nil
+	}
+	if current == "" { // fresh cluster, nothing to copy
+		return createIndex(ctx, client, spec)
+	}
+
+	if _, err := client.CreateIndex(target).Body(spec.Body).Do(ctx); err != nil {
+		if indexAlreadyExists(err) {
+			return fmt.Errorf("%s already exists, another migration is running or one was killed, delete %s to start over", target, target)
+		}
+		return err
+	}
+	logFor(ctx).Info("Created index", "index", target)
+	blocked := false
+	defer func() {
+		if err == nil {
+			return
+		}
+		if blocked { // writable again
+			if unblockErr := setWriteBlock(ctx, client, current, false); unblockErr != nil {
+				logFor(ctx).Error("Failed to lift the write block, lift it by hand", "index", current, "error", unblockErr)
+			}
+		}
+		if _, dropErr := client.DeleteIndex(target).Do(ctx); dropErr != nil {
+			logFor(ctx).Error("Failed to drop the new index, delete it by hand before a retry", "index", target, "error", dropErr)
+		}
+	}()
+
+	copied, err := copyIndex(ctx, client, spec, current, target)
+	if err != nil {
+		return err
+	}
+	logFor(ctx).Info("Copied index, catching up", "from", current, "to", target, "documents", copied.Total)
+
+	if err := setWriteBlock(ctx, client, current, true); err != nil {
+		return err
+	}
+	blocked = true
+	logFor(ctx).Warn("Index is write blocked until it is migrated", "index", current)
+	caughtUp, err := copyIndex(ctx, client, spec, current, target)
+	if err != nil {
+		return err
+	}
+	deleted, err := dropDeleted(ctx, client, current, target)
+	if err != nil {
+		return err
+	}
+
+	actions := []elastic.AliasAction{elastic.NewAliasAddAction(spec.Alias).Index(target)}
+	if legacy {
+		actions = append(actions, elastic.NewAliasRemoveIndexAction(current))
+	} else {
+		actions = append(actions, elastic.NewAliasRemoveAction(spec.Alias).Index(current))
+	}
+	if _, err := client.Alias().Action(actions...).Do(ctx); err != nil {
+		return err
+	}
+
+	logFor(ctx).Info("Migrated index", "alias", spec.Alias, "from", current, "to", target,
+		"documents", copied.Total, "caught_up", caughtUp.Created+caughtUp.Updated, "deleted", deleted)
+	return nil
+}
+
+// copyIndex reindexes source into target with the versions of source. Documents target already has in that
+// version are skipped, so a second run only copies what changed since the first.
+func copyIndex(ctx context.Context, client *elastic.Client, spec indexSpec, source, target string) (*elastic.BulkIndexByScrollResponse, error) {
+	reindex := client.Reindex().
+		Source(elastic.NewReindexSource().Index(source)).
+		Destination(elastic.NewReindexDestination().Index(target).VersionType("external")).
+		ProceedOnVersionConflict(). // not newer than the copy in target
+		Refresh("true")
+	if spec.Script != "" {
+		reindex = reindex.Script(elastic.NewScript(spec.Script))
+	}
+	return reindex.Do(ctx)
+}
+
+// dropDeleted deletes the documents of target that are gone from source. After the catch up target has every
+// document of source, so equal counts mean nothing was deleted and the ids are only compared otherwise.
+func dropDeleted(ctx context.Context, client *elastic.Client, source, target string) (int64, error) {
+	sourceCount, err := client.Count(source).Do(ctx)
+	if err != nil {
+		return 0, err
+	}
+	targetCount, err := client.Count(target).Do(ctx)
+	if err != nil || targetCount == sourceCount {
+		return 0, err
+	}
+
+	scroll := client.Scroll(target).FetchSource(false).Size(MIGRATE_BATCH)
+	defer scroll.Clear(context.Background())
+	var deleted int64
+	for {
+		page, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return deleted, nil
+		}
+		if err != nil {
+			return deleted, err
+		}
+
+		ids := make([]string, 0, len(page.Hits.Hits))
+		for _, hit := range page.Hits.Hits {
+			ids = append(ids, hit.Id)
+		}
+		found, err := client.Search(source).Query(elastic.NewIdsQuery().Ids(ids...)).FetchSource(false).Size(len(ids)).Do(ctx)
+		if err != nil {
+			return deleted, err
+		}
+		kept := make(map[string]bool, len(found.Hits.Hits))
+		for _, hit := range found.Hits.Hits {
+			kept[hit.Id] = true
+		}
+		var gone []string
+		for _, id := range ids {
+			if !kept[id] {
+				gone = append(gone, id)
+			}
+		}
+		if len(gone) == 0 {
+			continue
+		}
+		resp, err := client.DeleteByQuery(target).Query(elastic.NewIdsQuery().Ids(gone...)).Refresh("true").Do(ctx)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += resp.Deleted
+	}
+}
+
+// indexAlreadyExists is true for the error of creating an index that is there
+func indexAlreadyExists(err error) bool {
+	e, ok := err.(*elastic.Error)
+	return ok && e.Details != nil && e.Details.Type == "resource_already_exists_exception"
+}
+
+// setWriteBlock makes index read-only, or writable again
+func setWriteBlock(ctx context.Context, client *elastic.Client, index string, block bool) error {
+	_, err := client.IndexPutSettings(index).
+		BodyJson(map[string]interface{}{"index.blocks.write": block}).
+		Do(ctx)
+	return err
+}
+
+// aliasTarget returns the index behind alias, legacy is true when alias is itself a concrete index
+func aliasTarget(ctx context.Context, client *elastic.Client, alias string) (string, bool, error) {
+	exists, err := client.IndexExists(alias).Do(ctx) // true for an alias or an index
+	if err != nil || !exists {
+		return "", false, err
+	}
+
+	aliases, err := client.Aliases().Index(alias).Do(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	indices := aliases.IndicesByAlias(alias)
+	switch len(indices) {
+	case 0:
+		return alias, true, nil
+	case 1:
+		return indices[0], false, nil
+	default:
+		return "", false, fmt.Errorf("alias %s points to several indices %v", alias, indices)
+	}
+}
+
+// indexVersion parses N out of <alias>_vN, 0 for anything else
+func indexVersion(alias, index string) int {
+	if !strings.HasPrefix(index, alias+"_v") {
+		return 0
+	}
+	v, err := strconv.Atoi(strings.TrimPrefix(index, alias+"_v"))
+	if err != nil {
+		return 0
+	}
+	return v
+}
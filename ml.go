@@ -9,7 +9,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2/google"
 )
 
@@ -36,26 +39,122 @@ type MLRequestBody struct { // request structure
 }
 
 const (
-	// Replace this project ID and model name with your configuration.
-	PROJECT = "true-source-241502" // id
-	MODEL   = "my_model"           // model name
-	URL     = "https://ml.googleapis.com/v1/projects/" + PROJECT + "/models/" + MODEL + ":predict"
-	SCOPE   = "https://www.googleapis.com/auth/cloud-platform" // api scope
+	// project ID and model name come from config.MLProject and config.MLModel
+	ML_URL       = "https://ml.googleapis.com/v1/projects/%s/models/%s:predict"
+	ML_MODEL_URL = "https://ml.googleapis.com/v1/projects/%s/models/%s" // models.get, used as a health check
+	SCOPE        = "https://www.googleapis.com/auth/cloud-platform"     // api scope
+
+	ML_ERROR_BODY_MAX = 512 // bytes of a failed prediction response kept in the error
+
+	SCORER_CLOUDML   = "cloudml"
+	SCORER_TFSERVING = "tfserving"
+	SCORER_STATIC    = "static"
 )
 
+// FaceScorer gives the possibility that an image contains a face, handlerPost only depends on this
+type FaceScorer interface {
+	Score(ctx context.Context, r io.Reader) (float64, error) // ctx of the upload request, cancels the model call with it
+	Ping(ctx context.Context) error                          // nil if the model can be reached, for /readyz
+}
+
+var faceScorer FaceScorer // selected at startup in main
+
+// newFaceScorer picks the scorer by name, url is the TensorFlow Serving predict url and score is the static result
+func newFaceScorer(backend, url string, score float64) (FaceScorer, error) {
+	switch backend {
+	case SCORER_CLOUDML:
+		// DefaultClient returns an HTTP Client that uses the DefaultTokenSource to obtain authentication credentials
+		client, err := google.DefaultClient(context.Background(), SCOPE) // one for the process, it caches the token
+		if err != nil {
+			return nil, err
+		}
+		return &cloudMLScorer{client: client}, nil
+	case SCORER_TFSERVING:
+		if url == "" {
+			return nil, errors.New("TensorFlow Serving url is required")
+		}
+		return &tfServingScorer{url: url, client: &http.Client{Timeout: 30 * time.Second}}, nil
+	case SCORER_STATIC:
+		return &staticScorer{score: score}, nil
+	default:
+		return nil, fmt.Errorf("unknown face scorer %q", backend)
+	}
+}
+
+// cloudMLScorer calls the model deployed on Cloud ML Engine
+type cloudMLScorer struct {
+	client *http.Client // authenticated with the default credentials
+}
+
+func (s *cloudMLScorer) Score(ctx context.Context, r io.Reader) (float64, error) {
+	ctx, done := trackBackend(ctx, SCORER_CLOUDML, "annotate")
+	score, err := annotate(ctx, r, s.client, fmt.Sprintf(ML_URL, config.MLProject, config.MLModel))
+	return score, upstream(SCORER_CLOUDML, done(err))
+}
+
+func (s *cloudMLScorer) Ping(ctx context.Context) error {
+	return pingURL(ctx, s.client, fmt.Sprintf(ML_MODEL_URL, config.MLProject, config.MLModel))
+}
+
+// tfServingScorer calls a local TensorFlow Serving REST endpoint, e.g. http://localhost:8501/v1/models/my_model:predict
+// it accepts the same request/response body as Cloud ML Engine
+type tfServingScorer struct {
+	url    string
+	client *http.Client
+}
+
+func (s *tfServingScorer) Score(ctx context.Context, r io.Reader) (float64, error) {
+	ctx, done := trackBackend(ctx, SCORER_TFSERVING, "annotate")
+	score, err := annotate(ctx, r, s.client, s.url)
+	return score, upstream(SCORER_TFSERVING, done(err))
+}
+
+func (s *tfServingScorer) Ping(ctx context.Context) error {
+	// .../v1/models/my_model:predict -> .../v1/models/my_model, the model status endpoint
+	return pingURL(ctx, s.client, strings.TrimSuffix(s.url, ":predict"))
+}
+
+// staticScorer always returns the same score, for tests and offline runs
+type staticScorer struct {
+	score float64
+}
+
+func (s *staticScorer) Score(ctx context.Context, r io.Reader) (float64, error) {
+	if _, err := io.Copy(ioutil.Discard, r); err != nil { // still consume the upload like the real scorers
+		return 0.0, err
+	}
+	return s.score, nil
+}
+
+func (s *staticScorer) Ping(ctx context.Context) error {
+	return nil
+}
+
+// pingURL GETs url and expects a 2xx
+func pingURL(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body) // lets the connection be reused
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return nil
+}
+
 // Annotate an image file based on ml model, return score and error if exists. Provide face recognition
-func annotate(r io.Reader) (float64, error) { // take reader, return possibility in float
+func annotate(ctx context.Context, r io.Reader, client *http.Client, url string) (float64, error) { // take reader, return possibility in float
 	// func ReadAll(r io.Reader) ([]byte, error)
 	// ReadAll reads from r until an error or EOF and returns the data it read.
 	buf, err := ioutil.ReadAll(r) // read input from Reader
 	if err != nil {
-		fmt.Printf("Cannot read image data %v\n", err)
-		return 0.0, err
-	}
-	// DefaultClient returns an HTTP Client that uses the DefaultTokenSource to obtain authentication credentials
-	client, err := google.DefaultClient(context.Background(), SCOPE) // use default client constructor, include token, take new context
-	if err != nil {
-		fmt.Printf("Failed to create HTTP client %v\n", err)
+		logFor(ctx).Error("Cannot read image data", "error", err)
 		return 0.0, err
 	}
 
@@ -72,42 +171,63 @@ func annotate(r io.Reader) (float64, error) { // take reader, return possibility
 	}
 	jsonRequestBody, err := json.Marshal(requestBody) // change request body to json format, encoding
 	if err != nil {
-		fmt.Printf("Failed to create ML request body %v\n", err)
+		logFor(ctx).Error("Failed to create ML request body", "error", err)
 		return 0.0, err
 	}
 
-	request, err := http.NewRequest("POST", URL, strings.NewReader(string(jsonRequestBody))) // create http request, method, url, body(type reader)
+	request, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(string(jsonRequestBody))) // create http request, method, url, body(type reader)
+	if err != nil {
+		logFor(ctx).Error("Failed to create ML request", "error", err)
+		return 0.0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	injectTrace(ctx, request.Header) // TensorFlow Serving behind an instrumented proxy joins the trace
 
 	response, err := client.Do(request) // get response
 	if err != nil {
-		fmt.Printf("Failed to send ML request %v\n", err)
+		logFor(ctx).Error("Failed to send ML request", "error", err)
 		return 0.0, err
 	}
+	defer response.Body.Close()
 	// take out result
 	jsonResponseBody, err := ioutil.ReadAll(response.Body) // use ioutil.ReadAll() to read response
 	if err != nil {
-		fmt.Printf("Failed to get ML response body %v\n", err)
+		logFor(ctx).Error("Failed to get ML response body", "error", err)
 		return 0.0, err
 	}
+	// a failed prediction is not a result, its body is the error of the model server
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body := jsonResponseBody
+		if len(body) > ML_ERROR_BODY_MAX {
+			body = body[:ML_ERROR_BODY_MAX]
+		}
+		logFor(ctx).Error("Prediction failed", "status", response.StatusCode)
+		return 0.0, fmt.Errorf("prediction answered %s: %s", response.Status, body)
+	}
 	// sanity check
 	if len(jsonResponseBody) == 0 {
-		fmt.Println("Empty prediction response body")
+		logFor(ctx).Error("Empty prediction response body")
 		return 0.0, errors.New("Empty prediction response body")
 	}
 
 	var responseBody MLResponseBody
 	// Unmarshal parses the JSON-encoded data and stores the result in the value pointed to by v
 	if err := json.Unmarshal(jsonResponseBody, &responseBody); err != nil { // json to go struct
-		fmt.Printf("Failed to decode ML response %v\n", err)
+		logFor(ctx).Error("Failed to decode ML response", "error", err)
 		return 0.0, err
 	}
 	// sanity check
 	if len(responseBody.Predictions) == 0 {
-		fmt.Println("Empty prediction result")
+		logFor(ctx).Error("Empty prediction result")
 		return 0.0, errors.New("Empty prediction result")
 	}
 
 	results := responseBody.Predictions[0]
-	fmt.Printf("Received a prediction result %f\n", results.Scores[0])
+	if len(results.Scores) == 0 {
+		logFor(ctx).Error("Empty prediction scores")
+		return 0.0, errors.New("Empty prediction scores")
+	}
+	logFor(ctx).Debug("Received a prediction result", "score", results.Scores[0])
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("media.bytes", len(buf)), attribute.Float64("ml.score", results.Scores[0]))
 	return results.Scores[0], nil
 }
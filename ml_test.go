@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTFServingScorer(t *testing.T) {
+	setupMemory(t)
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		score  float64
+		err    string // part of the error, empty for success
+	}{
+		{"score", http.StatusOK, `{"predictions":[{"key":"1","scores":[0.93,0.07]}]}`, 0.93, ""},
+		{"model error", http.StatusBadRequest, `{"error":"Could not parse example input"}`, 0, "400 Bad Request: {\"error\":\"Could not parse example input\"}"},
+		{"long error", http.StatusInternalServerError, strings.Repeat("x", 2*ML_ERROR_BODY_MAX), 0, "500 Internal Server Error: " + strings.Repeat("x", ML_ERROR_BODY_MAX)},
+		{"no predictions", http.StatusOK, `{"predictions":[]}`, 0, "Empty prediction result"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got MLRequestBody
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&got)
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			scorer, err := newFaceScorer(SCORER_TFSERVING, server.URL+"/v1/models/face:predict", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			score, err := scorer.Score(context.Background(), strings.NewReader("image"))
+			if len(got.Instances) != 1 || string(got.Instances[0].ImageBytes.B64) != "image" {
+				t.Errorf("request = %+v, want the image bytes", got)
+			}
+			if tt.err == "" {
+				if err != nil || score != tt.score {
+					t.Errorf("Score = %v, %v, want %v", score, err, tt.score)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) || strings.Contains(err.Error(), tt.err+"x") {
+				t.Fatalf("err = %v, want %q", err, tt.err)
+			}
+			if !errors.Is(err, ErrUpstream) {
+				t.Errorf("err = %v, want it marked upstream", err)
+			}
+		})
+	}
+}
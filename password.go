@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/subtle"
+	"strings"
+	"sync"
+
+	"github.com/pborman/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	BCRYPT_COST         = 12 // work factor, raise it as hardware gets faster
+	BCRYPT_MAX_PASSWORD = 72 // bytes, bcrypt refuses longer passwords
+)
+
+// hashPassword returns a salted bcrypt hash, e.g. "$2a$12$<salt><hash>", cost and salt are encoded in the string
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), BCRYPT_COST)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte // hash of a password nobody has, at BCRYPT_COST
+)
+
+// burnPassword takes as long as checking password against a real hash, so a login for an unknown username
+// answers no faster than a wrong password and does not reveal which usernames exist
+func burnPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte(uuid.New()), BCRYPT_COST)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+// isPasswordHash tells a bcrypt hash from a legacy plaintext password
+func isPasswordHash(stored string) bool {
+	_, err := bcrypt.Cost([]byte(stored))
+	return strings.HasPrefix(stored, "$2") && err == nil
+}
+
+// verifyPassword compares password with the stored value in constant time.
+// rehash is true when the stored value is plaintext or uses an older cost and should be replaced.
+func verifyPassword(stored, password string) (ok bool, rehash bool) {
+	if !isPasswordHash(stored) { // legacy plaintext record
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return ok, ok
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)); err != nil {
+		return false, false
+	}
+	cost, _ := bcrypt.Cost([]byte(stored))
+	return true, cost < BCRYPT_COST
+}
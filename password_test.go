@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	current, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cheap, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		stored   string
+		password string
+		ok       bool
+		rehash   bool
+	}{
+		{"current hash", current, "secret", true, false},
+		{"current hash, wrong password", current, "Secret", false, false},
+		{"older cost", string(cheap), "secret", true, true},
+		{"older cost, wrong password", string(cheap), "nope", false, false},
+		{"legacy plaintext", "secret", "secret", true, true},
+		{"legacy plaintext, wrong password", "secret", "secret2", false, false},
+		{"legacy plaintext that looks like a hash", "$2bogus", "$2bogus", true, true},
+		{"empty password", current, "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, rehash := verifyPassword(tt.stored, tt.password)
+			if ok != tt.ok || rehash != tt.rehash {
+				t.Errorf("verifyPassword = %v, %v, want %v, %v", ok, rehash, tt.ok, tt.rehash)
+			}
+		})
+	}
+}
+
+func TestHashPasswordTooLong(t *testing.T) {
+	if _, err := hashPassword(string(make([]byte, BCRYPT_MAX_PASSWORD+1))); err == nil {
+		t.Error("hashPassword accepted a password bcrypt truncates")
+	}
+}
+
+func TestBurnPassword(t *testing.T) {
+	burnPassword("secret")
+	if cost, err := bcrypt.Cost(dummyHash); err != nil || cost != BCRYPT_COST {
+		t.Errorf("dummy hash cost = %d, %v, want %d like real hashes", cost, err, BCRYPT_COST)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+)
+
+// postUpdate is the body of PUT /post/{id}, missing fields are left unchanged
+type postUpdate struct {
+	Message  *string   `json:"message"`
+	Location *Location `json:"location"`
+}
+
+// usernameFromRequest reads the username claim put in the context by jwtMiddleware
+func usernameFromRequest(r *http.Request) string {
+	token, ok := r.Context().Value("user").(*jwt.Token)
+	if !ok {
+		return ""
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return ""
+	}
+	username, _ := claims["username"].(string)
+	return username
+}
+
+// loadPost fetches the post of the {id} route variable and writes the error response if it fails
+func loadPost(w http.ResponseWriter, r *http.Request) (*Post, string, bool) {
+	id := mux.Vars(r)["id"]
+	p, err := postStore.Get(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, errPostNotFound) {
+			writeError(w, r, err, "Post not found")
+		} else {
+			writeError(w, r, err, "Failed to read post")
+		}
+		return nil, id, false
+	}
+	return p, id, true
+}
+
+// loadOwnPost is loadPost plus a check that the logged in user wrote the post
+func loadOwnPost(w http.ResponseWriter, r *http.Request) (*Post, string, bool) {
+	p, id, ok := loadPost(w, r)
+	if !ok {
+		return nil, id, false
+	}
+	if username := usernameFromRequest(r); p.User != username {
+		writeError(w, r, fmt.Errorf("user %s cannot change post %s of %s: %w", username, id, p.User, ErrForbidden), "Post belongs to another user")
+		return nil, id, false
+	}
+	return p, id, true
+}
+
+func writePost(w http.ResponseWriter, r *http.Request, p *Post) {
+	js, err := json.Marshal(p)
+	if err != nil {
+		writeError(w, r, err, "Failed to parse post into JSON format")
+		return
+	}
+	w.Write(js)
+}
+
+func handlerGetPost(w http.ResponseWriter, r *http.Request) {
+	logFor(r.Context()).Debug("Received one get post request")
+	w.Header().Set("Content-Type", "application/json")
+
+	p, _, ok := loadPost(w, r)
+	if !ok {
+		return
+	}
+	writePost(w, r, p)
+}
+
+func handlerUpdatePost(w http.ResponseWriter, r *http.Request) {
+	logFor(r.Context()).Debug("Received one update post request")
+	w.Header().Set("Content-Type", "application/json")
+
+	p, id, ok := loadOwnPost(w, r)
+	if !ok {
+		return
+	}
+
+	var update postUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, r, invalidField("body", "cannot decode post data: %v", err), "Cannot decode post data from client")
+		return
+	}
+	if update.Message != nil {
+		p.Message = *update.Message
+		p.Tags = extractTags(p.Message)
+	}
+	if update.Location != nil {
+		if err := checkLocation("location", *update.Location); err != nil {
+			writeError(w, r, err, "Invalid location")
+			return
+		}
+		p.Location = *update.Location
+	}
+	p.UpdatedAt = time.Now().UTC()
+
+	if err := postStore.Save(r.Context(), p, id); err != nil { // p carries the version loadOwnPost read
+		writeError(w, r, err, "Failed to save post") // 409 if it was edited in the meantime
+		return
+	}
+	if config.BigtableEnabled {
+		if err := saveToBigTable(r.Context(), p, id); err != nil {
+			writeError(w, r, upstream("bigtable", err), "Failed to save post to BigTable")
+			return
+		}
+	}
+	logFor(r.Context()).Info("Updated post", "id", id)
+	writePost(w, r, p)
+}
+
+func handlerDeletePost(w http.ResponseWriter, r *http.Request) {
+	logFor(r.Context()).Debug("Received one delete post request")
+
+	_, id, ok := loadOwnPost(w, r)
+	if !ok {
+		return
+	}
+
+	// the post goes first, a leftover media file or row is harmless but a post pointing at nothing is not
+	if err := postStore.Delete(r.Context(), id); err != nil && !errors.Is(err, errPostNotFound) {
+		writeError(w, r, err, "Failed to delete post")
+		return
+	}
+	if err := mediaStore.Delete(r.Context(), id); err != nil && !errors.Is(err, errMediaNotFound) { // media is saved under the post id
+		writeError(w, r, err, "Failed to delete media")
+		return
+	}
+	if config.BigtableEnabled {
+		if err := deleteFromBigTable(r.Context(), id); err != nil {
+			writeError(w, r, upstream("bigtable", err), "Failed to delete post from BigTable")
+			return
+		}
+	}
+
+	logFor(r.Context()).Info("Deleted post", "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	LIMITER_MEMORY = "memory"
+	LIMITER_REDIS  = "redis"
+
+	REDIS_KEY_PREFIX = "around:ratelimit:"
+	PRUNE_INTERVAL   = time.Minute // how often the memory limiter drops full buckets and expired entries
+)
+
+// Rate allows Count requests per Per, as a token bucket: a burst of Count, then one every Per/Count
+type Rate struct {
+	Count int
+	Per   time.Duration
+}
+
+// parseRate reads "5/1m", "100/1h" and the like
+func parseRate(s string) (Rate, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return Rate{}, fmt.Errorf("rate %q is not count/duration", s)
+	}
+	count, err := strconv.Atoi(parts[0])
+	if err != nil || count <= 0 {
+		return Rate{}, fmt.Errorf("rate %q needs a positive count", s)
+	}
+	per, err := time.ParseDuration(parts[1])
+	if err != nil || per <= 0 {
+		return Rate{}, fmt.Errorf("rate %q needs a positive duration", s)
+	}
+	return Rate{Count: count, Per: per}, nil
+}
+
+// RateLimiter keeps the token buckets, failed login counters and lockouts, shared by all instances with redis
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, rate Rate) (time.Duration, error) // takes a token, or says how long until there is one
+	Fail(ctx context.Context, key string, ttl time.Duration) (int, error)    // counts a failure and returns the count, forgotten ttl after the last one
+	Lock(ctx context.Context, key string, d time.Duration) error
+	LockedFor(ctx context.Context, key string) (time.Duration, error) // 0 if not locked
+	Reset(ctx context.Context, key string) error                      // clears failures and lock
+	Ping(ctx context.Context) error
+}
+
+var rateLimiter RateLimiter // selected at startup in main
+
+var loginIPRate, loginUserRate, loginUserGlobalRate, signupIPRate Rate // parsed from config by setupRateLimits
+
+// setupRateLimits creates the configured limiter and parses the rates
+func setupRateLimits() error {
+	var err error
+	if rateLimiter, err = newRateLimiter(config.RateLimiter); err != nil {
+		return err
+	}
+	for _, r := range []struct {
+		rate *Rate
+		val  string
+	}{{&loginIPRate, config.LoginRateIP}, {&loginUserRate, config.LoginRateUser},
+		{&loginUserGlobalRate, config.LoginRateUserGlobal}, {&signupIPRate, config.SignupRateIP}} {
+		if *r.rate, err = parseRate(r.val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newRateLimiter picks the backend by name
+func newRateLimiter(backend string) (RateLimiter, error) {
+	switch backend {
+	case LIMITER_MEMORY:
+		return newMemoryRateLimiter(), nil
+	case LIMITER_REDIS:
+		opts, err := redis.ParseURL(config.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+		return &redisRateLimiter{client: redis.NewClient(opts)}, nil
+	default:
+		return nil, fmt.Errorf("unknown rate limiter %q", backend)
+	}
+}
+
+// memoryRateLimiter only limits per instance, behind a load balancer every instance has its own buckets
+type memoryRateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	failures  map[string]failures
+	locks     map[string]time.Time // key -> until
+	lastPrune time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	rate   Rate
+}
+
+type failures struct {
+	count   int
+	expires time.Time
+}
+
+func newMemoryRateLimiter() *memoryRateLimiter {
+	return &memoryRateLimiter{
+		buckets:  make(map[string]*bucket),
+		failures: make(map[string]failures),
+		locks:    make(map[string]time.Time),
+	}
+}
+
+// refill adds the tokens earned since the last call, up to the burst
+func (b *bucket) refill(now time.Time) {
+	perToken := b.rate.Per.Seconds() / float64(b.rate.Count)
+	b.tokens = math.Min(float64(b.rate.Count), b.tokens+now.Sub(b.last).Seconds()/perToken)
+	b.last = now
+}
+
+func (s *memoryRateLimiter) Allow(ctx context.Context, key string, rate Rate) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.prune(now)
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rate.Count), last: now, rate: rate}
+		s.buckets[key] = b
+	}
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, nil
+	}
+	perToken := rate.Per.Seconds() / float64(rate.Count)
+	return time.Duration((1 - b.tokens) * perToken * float64(time.Second)), nil
+}
+
+// prune drops what no longer limits anyone, so one-off IPs do not pile up
+func (s *memoryRateLimiter) prune(now time.Time) {
+	if now.Sub(s.lastPrune) < PRUNE_INTERVAL {
+		return
+	}
+	s.lastPrune = now
+	for key, b := range s.buckets {
+		if b.refill(now); b.tokens >= float64(b.rate.Count) {
+			delete(s.buckets, key)
+		}
+	}
+	for key, f := range s.failures {
+		if now.After(f.expires) {
+			delete(s.failures, key)
+		}
+	}
+	for key, until := range s.locks {
+		if now.After(until) {
+			delete(s.locks, key)
+		}
+	}
+}
+
+func (s *memoryRateLimiter) Fail(ctx context.Context, key string, ttl time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	f := s.failures[key]
+	if now.After(f.expires) {
+		f.count = 0
+	}
+	f.count++
+	f.expires = now.Add(ttl)
+	s.failures[key] = f
+	return f.count, nil
+}
+
+func (s *memoryRateLimiter) Lock(ctx context.Context, key string, d time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.locks[key] = time.Now().Add(d)
+	return nil
+}
+
+func (s *memoryRateLimiter) LockedFor(ctx context.Context, key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if left := time.Until(s.locks[key]); left > 0 {
+		return left, nil
+	}
+	return 0, nil
+}
+
+func (s *memoryRateLimiter) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.failures, key)
+	delete(s.locks, key)
+	return nil
+}
+
+func (s *memoryRateLimiter) Ping(ctx context.Context) error {
+	return nil
+}
+
+// redisRateLimiter shares the limits between instances
+type redisRateLimiter struct {
+	client *redis.Client
+}
+
+// tokenBucketScript refills and takes a token atomically. The bucket is a hash of tokens and the time of the
+// last call in ms, it expires once it would be full again. Returns 0 or the ms until the next token.
+var tokenBucketScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local per_token = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local tokens = tonumber(redis.call("HGET", KEYS[1], "tokens") or burst)
+local last = tonumber(redis.call("HGET", KEYS[1], "last") or now)
+tokens = math.min(burst, tokens + (now - last) / per_token)
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) * per_token)
+end
+redis.call("HSET", KEYS[1], "tokens", tokens, "last", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst - tokens) * per_token) + 1000)
+return wait
+`)
+
+func (s *redisRateLimiter) Allow(ctx context.Context, key string, rate Rate) (time.Duration, error) {
+	ctx, done := trackBackend(ctx, LIMITER_REDIS, "allow")
+	perToken := float64(rate.Per.Milliseconds()) / float64(rate.Count)
+	wait, err := tokenBucketScript.Run(ctx, s.client, []string{REDIS_KEY_PREFIX + "bucket:" + key},
+		rate.Count, perToken, time.Now().UnixMilli()).Int64()
+	return time.Duration(wait) * time.Millisecond, upstream(LIMITER_REDIS, done(err))
+}
+
+func (s *redisRateLimiter) Fail(ctx context.Context, key string, ttl time.Duration) (int, error) {
+	ctx, done := trackBackend(ctx, LIMITER_REDIS, "fail")
+	pipe := s.client.TxPipeline() // MULTI, so the counter never lives without its expiry
+	incr := pipe.Incr(ctx, REDIS_KEY_PREFIX+"failures:"+key)
+	pipe.PExpire(ctx, REDIS_KEY_PREFIX+"failures:"+key, ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, upstream(LIMITER_REDIS, done(err))
+	}
+	return int(incr.Val()), done(nil)
+}
+
+func (s *redisRateLimiter) Lock(ctx context.Context, key string, d time.Duration) error {
+	ctx, done := trackBackend(ctx, LIMITER_REDIS, "lock")
+	err := s.client.Set(ctx, REDIS_KEY_PREFIX+"lock:"+key, 1, d).Err()
+	return upstream(LIMITER_REDIS, done(err))
+}
+
+func (s *redisRateLimiter) LockedFor(ctx context.Context, key string) (time.Duration, error) {
+	ctx, done := trackBackend(ctx, LIMITER_REDIS, "locked")
+	left, err := s.client.PTTL(ctx, REDIS_KEY_PREFIX+"lock:"+key).Result()
+	if err != nil {
+		return 0, upstream(LIMITER_REDIS, done(err))
+	}
+	if left < 0 { // -2 missing, -1 no expiry which Lock never sets
+		left = 0
+	}
+	return left, done(nil)
+}
+
+func (s *redisRateLimiter) Reset(ctx context.Context, key string) error {
+	ctx, done := trackBackend(ctx, LIMITER_REDIS, "reset")
+	err := s.client.Del(ctx, REDIS_KEY_PREFIX+"failures:"+key, REDIS_KEY_PREFIX+"lock:"+key).Err()
+	return upstream(LIMITER_REDIS, done(err))
+}
+
+func (s *redisRateLimiter) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+func (s *redisRateLimiter) Close() error {
+	return s.client.Close()
+}
+
+// checkRate refuses the request once key has used up rate. A limiter that cannot be reached lets requests through,
+// the login itself still needs the password.
+func checkRate(ctx context.Context, key string, rate Rate) error {
+	wait, err := rateLimiter.Allow(ctx, key, rate)
+	if err != nil {
+		logFor(ctx).Error("Rate limiter failed, allowing the request", "key", key, "error", err)
+		return nil
+	}
+	if wait > 0 {
+		return &rateLimitError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// lockoutKey is per username and IP, so an attacker elsewhere cannot lock a user out. Guessing one password
+// from many IPs is bounded by login_rate_user_global instead.
+func lockoutKey(username, ip string) string {
+	return "login:" + username + "|" + ip
+}
+
+// checkLockout refuses logins of a username from ip while it is locked out
+func checkLockout(ctx context.Context, username, ip string) error {
+	left, err := rateLimiter.LockedFor(ctx, lockoutKey(username, ip))
+	if err != nil {
+		logFor(ctx).Error("Rate limiter failed, allowing the login", "error", err)
+		return nil
+	}
+	if left > 0 {
+		return &rateLimitError{RetryAfter: left}
+	}
+	return nil
+}
+
+// loginFailed counts a wrong password. From login_lockout_threshold failures on, every further one locks
+// the username and IP out, for login_lockout twice as long each time up to login_lockout_max.
+func loginFailed(ctx context.Context, username, ip string) {
+	key := lockoutKey(username, ip)
+	count, err := rateLimiter.Fail(ctx, key, config.LoginLockoutMax)
+	if err != nil {
+		logFor(ctx).Error("Failed to count the failed login", "user", username, "error", err)
+		return
+	}
+	if count < config.LoginLockoutThreshold {
+		return
+	}
+
+	d := config.LoginLockoutMax
+	if shift := count - config.LoginLockoutThreshold; shift < 32 { // beyond that the shift overflows, max anyway
+		if doubled := config.LoginLockout << uint(shift); doubled > 0 && doubled < d {
+			d = doubled
+		}
+	}
+	if err := rateLimiter.Lock(ctx, key, d); err != nil {
+		logFor(ctx).Error("Failed to lock out the login", "user", username, "error", err)
+		return
+	}
+	logFor(ctx).Warn("Login is locked out", "user", username, "ip", ip, "failures", count, "for", d.String())
+}
+
+// loginSucceeded forgets the failures of username from ip
+func loginSucceeded(ctx context.Context, username, ip string) {
+	if err := rateLimiter.Reset(ctx, lockoutKey(username, ip)); err != nil {
+		logFor(ctx).Error("Failed to reset failed logins", "user", username, "error", err)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		val  string
+		want Rate
+		ok   bool
+	}{
+		{"5/1m", Rate{Count: 5, Per: time.Minute}, true},
+		{"1000/1h", Rate{Count: 1000, Per: time.Hour}, true},
+		{"5", Rate{}, false},
+		{"0/1m", Rate{}, false},
+		{"-1/1m", Rate{}, false},
+		{"5/0s", Rate{}, false},
+		{"5/minute", Rate{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseRate(tt.val)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseRate(%q) = %v, %v, want %v ok %v", tt.val, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestBucketRefill(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := &bucket{tokens: 0, last: start, rate: Rate{Count: 10, Per: 10 * time.Second}}
+
+	b.refill(start.Add(3 * time.Second))
+	if b.tokens != 3 {
+		t.Errorf("tokens after 3s = %v, want 3", b.tokens)
+	}
+	b.refill(start.Add(3500 * time.Millisecond))
+	if b.tokens != 3.5 {
+		t.Errorf("tokens after 3.5s = %v, want 3.5", b.tokens)
+	}
+	b.refill(start.Add(time.Hour))
+	if b.tokens != 10 {
+		t.Errorf("tokens after an hour = %v, want the burst of 10", b.tokens)
+	}
+}
+
+func TestMemoryRateLimiterAllow(t *testing.T) {
+	ctx := context.Background()
+	limiter := newMemoryRateLimiter()
+	rate := Rate{Count: 2, Per: 200 * time.Millisecond} // a token every 100ms
+
+	for i := 0; i < 2; i++ {
+		if wait, _ := limiter.Allow(ctx, "ip", rate); wait != 0 {
+			t.Fatalf("request %d of the burst waits %v", i+1, wait)
+		}
+	}
+	wait, _ := limiter.Allow(ctx, "ip", rate)
+	if wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatalf("wait after the burst = %v, want up to 100ms", wait)
+	}
+	if wait, _ := limiter.Allow(ctx, "other ip", rate); wait != 0 {
+		t.Errorf("another key waits %v", wait)
+	}
+
+	time.Sleep(wait + 10*time.Millisecond)
+	if wait, _ := limiter.Allow(ctx, "ip", rate); wait != 0 {
+		t.Errorf("wait after a refill = %v, want 0", wait)
+	}
+	if wait, _ := limiter.Allow(ctx, "ip", rate); wait == 0 {
+		t.Error("a second request got the one refilled token too")
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	setupMemory(t)
+	ctx := context.Background()
+	config.LoginLockoutThreshold = 3
+	config.LoginLockout = time.Minute
+	config.LoginLockoutMax = 4 * time.Minute
+
+	for i, want := range []time.Duration{0, 0, time.Minute, 2 * time.Minute, 4 * time.Minute, 4 * time.Minute} {
+		loginFailed(ctx, "alice", "1.2.3.4")
+		left, _ := rateLimiter.LockedFor(ctx, lockoutKey("alice", "1.2.3.4"))
+		if left > want || left < want-time.Second {
+			t.Errorf("after %d failures locked for %v, want %v", i+1, left, want)
+		}
+	}
+	if err := checkLockout(ctx, "alice", "1.2.3.4"); err == nil {
+		t.Error("checkLockout let a locked out login through")
+	}
+	if err := checkLockout(ctx, "alice", "5.6.7.8"); err != nil {
+		t.Errorf("another IP is locked out too: %v", err)
+	}
+	loginSucceeded(ctx, "alice", "1.2.3.4")
+	if err := checkLockout(ctx, "alice", "1.2.3.4"); err != nil {
+		t.Errorf("still locked out after a login: %v", err)
+	}
+}
+
+func TestLoginLockoutExpires(t *testing.T) {
+	setupMemory(t)
+	ctx := context.Background()
+	config.LoginLockoutThreshold = 1
+	config.LoginLockout = 20 * time.Millisecond
+	config.LoginLockoutMax = 40 * time.Millisecond // also how long failures are remembered
+
+	loginFailed(ctx, "alice", "1.2.3.4")
+	if err := checkLockout(ctx, "alice", "1.2.3.4"); err == nil {
+		t.Fatal("not locked out")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := checkLockout(ctx, "alice", "1.2.3.4"); err != nil {
+		t.Fatalf("still locked out after the lockout ended: %v", err)
+	}
+
+	// the failures are forgotten as well, so the next lockout starts short again
+	loginFailed(ctx, "alice", "1.2.3.4")
+	if left, _ := rateLimiter.LockedFor(ctx, lockoutKey("alice", "1.2.3.4")); left > 20*time.Millisecond {
+		t.Errorf("locked for %v after the failures expired, want the first lockout again", left)
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	setupMemory(t)
+	tests := []struct {
+		name    string
+		proxies int
+		xff     []string // one X-Forwarded-For header per entry
+		want    string
+	}{
+		{"no proxies", 0, nil, "10.0.0.1"},
+		{"no proxies ignores xff", 0, []string{"6.6.6.6"}, "10.0.0.1"},
+		{"one hop", 1, []string{"1.2.3.4"}, "1.2.3.4"},
+		{"one hop spoofed", 1, []string{"6.6.6.6, 1.2.3.4"}, "1.2.3.4"},
+		{"two hops", 2, []string{"1.2.3.4, 10.1.1.1"}, "1.2.3.4"},
+		{"two hops spoofed", 2, []string{"6.6.6.6, 1.2.3.4, 10.1.1.1"}, "1.2.3.4"},
+		{"more hops than entries", 3, []string{"1.2.3.4, 10.1.1.1"}, "10.0.0.1"},
+		{"no xff", 1, nil, "10.0.0.1"},
+		{"several headers", 2, []string{"6.6.6.6", "1.2.3.4", "10.1.1.1"}, "1.2.3.4"},
+		{"several headers with lists", 2, []string{"6.6.6.6, 1.2.3.4", "10.1.1.1"}, "1.2.3.4"},
+		{"spaces", 1, []string{"  1.2.3.4  "}, "1.2.3.4"},
+		{"no spaces", 2, []string{"1.2.3.4,10.1.1.1"}, "1.2.3.4"},
+		{"empty entry at the hop", 2, []string{"1.2.3.4, , 10.1.1.1"}, "10.0.0.1"},
+		{"empty entry left of the hop", 1, []string{", 1.2.3.4"}, "1.2.3.4"},
+		{"empty header", 1, []string{""}, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.TrustedProxies = tt.proxies
+			r := httptest.NewRequest("POST", "/login", nil)
+			r.RemoteAddr = "10.0.0.1:54321"
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := remoteIP(r); got != tt.want {
+				t.Errorf("remoteIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
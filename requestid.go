@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/pborman/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+type contextKey string
+
+const requestIDKey contextKey = "request_id"
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`) // ids from a proxy are kept if they look harmless
+
+// withRequestID gives every request an id, taken from X-Request-ID or generated, and echoes it in the response
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(REQUEST_ID_HEADER)
+		if !requestIDPattern.MatchString(id) {
+			id = uuid.New()
+		}
+		w.Header().Set(REQUEST_ID_HEADER, id)
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("request.id", id)) // find the trace of a reported error
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// requestIDFromRequest returns the id set by withRequestID, empty outside of it
+func requestIDFromRequest(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
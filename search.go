@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+const (
+	SORT_DISTANCE  = "distance"  // nearest first, only for searches around a point
+	SORT_NEWEST    = "newest"    // created_at descending
+	SORT_FACE      = "face"      // face score descending
+	SORT_RELEVANCE = "relevance" // best match of the q words first, only with q
+
+	DEFAULT_LIMIT = 20
+	MAX_LIMIT     = 100
+)
+
+// SearchOptions controls paging and ordering of a post search
+type SearchOptions struct {
+	Text  string // full-text query on message and tags, empty for none
+	Sort  string
+	Limit int
+	After []interface{} // sort values of the last post of the previous page as json.Number and string, nil for the first page
+}
+
+// PostPage is the response envelope of /search and /cluster
+type PostPage struct {
+	Posts      []Post `json:"posts"`
+	NextCursor string `json:"next_cursor,omitempty"` // pass as cursor to get the next page, empty on the last page
+	Total      int64  `json:"total"`                 // number of matching posts over all pages
+}
+
+// cursor is what next_cursor encodes, the sort is kept so a cursor cannot be replayed with another order
+type cursor struct {
+	Sort  string        `json:"sort"`
+	After []interface{} `json:"after"`
+}
+
+func encodeCursor(sort string, after []interface{}) (string, error) {
+	js, err := json.Marshal(cursor{Sort: sort, After: after})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(js), nil
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	js, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	// UseNumber keeps the sort values exactly as Elasticsearch sent them, a long does not survive a float64
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	var c cursor
+	if err := dec.Decode(&c); err != nil || len(c.After) != 2 {
+		return nil, errors.New("invalid cursor")
+	}
+	// every sort is the sort value, a number, then the post id as tie-breaker, see esSorters
+	if _, ok := c.After[0].(json.Number); !ok {
+		return nil, errors.New("invalid cursor")
+	}
+	if _, ok := c.After[1].(string); !ok {
+		return nil, errors.New("invalid cursor")
+	}
+	return &c, nil
+}
+
+// parseSearchOptions reads limit, cursor and sort from the query string, allowed lists the valid sorts
+func parseSearchOptions(r *http.Request, defaultSort string, allowed ...string) (SearchOptions, error) {
+	opts := SearchOptions{Sort: defaultSort, Limit: DEFAULT_LIMIT}
+	query := r.URL.Query()
+
+	if val := query.Get("sort"); val != "" {
+		opts.Sort = val
+	}
+	ok := false
+	for _, sort := range allowed {
+		ok = ok || sort == opts.Sort
+	}
+	if !ok {
+		return opts, invalidField("sort", "sort must be one of %v", allowed)
+	}
+
+	if val := query.Get("limit"); val != "" {
+		limit, err := strconv.Atoi(val)
+		if err != nil || limit < 1 || limit > MAX_LIMIT {
+			return opts, invalidField("limit", "limit must be between 1 and %d", MAX_LIMIT)
+		}
+		opts.Limit = limit
+	}
+
+	if val := query.Get("cursor"); val != "" {
+		c, err := decodeCursor(val)
+		if err != nil {
+			return opts, invalidField("cursor", "%s", err.Error())
+		}
+		if c.Sort != opts.Sort {
+			return opts, invalidField("cursor", "cursor was created for another sort")
+		}
+		opts.After = c.After
+	}
+	return opts, nil
+}
+
+// writePostPage sends a page of posts as JSON
+func writePostPage(w http.ResponseWriter, r *http.Request, page *PostPage) {
+	if page.Posts == nil {
+		page.Posts = []Post{} // [] rather than null
+	}
+	js, err := json.Marshal(page) // Convert the go object to a string
+	if err != nil {
+		writeError(w, r, err, "Failed to parse posts into JSON format")
+		return
+	}
+	w.Write(js)
+}
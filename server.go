@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newServer wraps handler in an http.Server with the configured timeouts and TLS
+func newServer(handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:              ":" + config.Port,
+		Handler:           handler,
+		ReadHeaderTimeout: config.ReadHeaderTimeout, // slow clients cannot hold a connection open without sending a request
+		ReadTimeout:       config.ReadTimeout,       // whole request including the upload body
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout, // keep-alive connections between requests
+	}
+	if len(config.AutocertDomains) > 0 {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(config.AutocertDomains...),
+			Cache:      autocert.DirCache(config.AutocertCacheDir), // certificates survive restarts, Let's Encrypt rate limits
+		}
+		srv.TLSConfig = manager.TLSConfig() // tls-alpn-01 challenges, so port must be reachable as 443
+	}
+	return srv
+}
+
+// newMetricsServer serves /metrics on metrics_addr, apart from the public port so it needs no auth
+func newMetricsServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return &http.Server{
+		Addr:              config.MetricsAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadHeaderTimeout, // scrapes have no body
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+}
+
+// serve runs srv until it fails or stops, http.ErrServerClosed means it was shut down
+func serve(srv *http.Server) error {
+	switch {
+	case srv.TLSConfig != nil:
+		logger.Info("Listening with autocert", "addr", srv.Addr, "domains", config.AutocertDomains)
+		return srv.ListenAndServeTLS("", "") // certificates come from TLSConfig.GetCertificate
+	case config.TLSCertFile != "":
+		logger.Info("Listening with TLS", "addr", srv.Addr)
+		return srv.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+	default:
+		logger.Info("Listening", "addr", srv.Addr)
+		return srv.ListenAndServe()
+	}
+}
+
+// runServer serves until SIGTERM or SIGINT, then stops accepting connections and gives in-flight requests,
+// uploads included, shutdown_timeout to finish before the process exits. metrics is nil if metrics_addr is empty.
+func runServer(srv, metrics *http.Server) error {
+	errs := make(chan error, 2)
+	go func() {
+		errs <- serve(srv)
+	}()
+	if metrics != nil {
+		go func() {
+			logger.Info("Serving metrics", "addr", metrics.Addr)
+			errs <- metrics.ListenAndServe()
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT) // SIGTERM from Kubernetes/App Engine, SIGINT from ctrl-c
+	defer signal.Stop(stop)
+
+	select {
+	case err := <-errs:
+		return err // could not listen, nothing to drain
+	case sig := <-stop:
+		logger.Info("Draining requests", "signal", sig.String(), "timeout", config.ShutdownTimeout.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		srv.Close() // deadline passed, cut off whatever is left
+	}
+	if metrics != nil {
+		metrics.Close() // scrapes are short, nothing to drain
+	}
+	closeClients()
+	return err
+}
+
+// closeClients releases the long-lived clients
+func closeClients() {
+	if esClient != nil {
+		esClient.Stop() // ends the health checks
+	}
+	if c, ok := rateLimiter.(io.Closer); ok {
+		c.Close()
+	}
+	if c, ok := mediaStore.(io.Closer); ok {
+		c.Close()
+	}
+	if btClient != nil {
+		btClient.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), TRACE_FLUSH_TIMEOUT)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Warn("Failed to flush traces", "error", err)
+	}
+	logger.Info("stopped-service")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+const (
+	STORE_ELASTICSEARCH = "elasticsearch"
+	STORE_MEMORY        = "memory"
+)
+
+var (
+	errPostNotFound = fmt.Errorf("Post %w", ErrNotFound)
+	errPostConflict = fmt.Errorf("Post %w", ErrConflict)
+)
+
+// PostStore hides where posts are persisted, handlers only talk to this interface
+type PostStore interface {
+	EnsureSchema(ctx context.Context) error                                                                  // create indices/tables if they are missing
+	Save(ctx context.Context, post *Post, id string) error                                                   // save a post under id, replaces an existing one unless post.Version is stale (errPostConflict)
+	Get(ctx context.Context, id string) (*Post, error)                                                       // errPostNotFound if missing, sets Version
+	Delete(ctx context.Context, id string) error                                                             // errPostNotFound if missing
+	GeoSearch(ctx context.Context, lat, lon float64, distance string, opts SearchOptions) (*PostPage, error) // posts within distance (e.g. "200km") of lat/lon
+	BoxSearch(ctx context.Context, box BoundingBox, opts SearchOptions) (*PostPage, error)                   // posts inside a lat/lon rectangle
+	PolygonSearch(ctx context.Context, ring []Location, opts SearchOptions) (*PostPage, error)               // posts inside a polygon, ring is not closed
+	RangeSearch(ctx context.Context, field string, gte float64, opts SearchOptions) (*PostPage, error)       // posts whose numeric field >= gte
+	TagSearch(ctx context.Context, tag string, opts SearchOptions) (*PostPage, error)                        // posts with a hashtag
+	Heatmap(ctx context.Context, box BoundingBox, precision int, filter HeatmapFilter) ([]HeatCell, error)   // post counts per geohash cell of precision characters
+}
+
+var postStore PostStore // selected at startup in main
+
+// newPostStore picks the backend by name
+func newPostStore(backend string) (PostStore, error) {
+	switch backend {
+	case STORE_ELASTICSEARCH:
+		return &elasticPostStore{}, nil
+	case STORE_MEMORY:
+		return newMemoryPostStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown post store %q", backend)
+	}
+}
+
+// elasticPostStore is the Elasticsearch backend, a thin wrapper around the ES helpers in main.go.
+// Every error except errPostNotFound and errPostConflict comes back marked as ErrUpstream.
+type elasticPostStore struct{}
+
+func (s *elasticPostStore) EnsureSchema(ctx context.Context) error {
+	return upstream(STORE_ELASTICSEARCH, createIndexIfNotExist(ctx))
+}
+
+func (s *elasticPostStore) Save(ctx context.Context, post *Post, id string) error {
+	return upstream(STORE_ELASTICSEARCH, saveToES(ctx, post, id))
+}
+
+func (s *elasticPostStore) Get(ctx context.Context, id string) (*Post, error) {
+	p, err := getFromES(ctx, id)
+	return p, upstream(STORE_ELASTICSEARCH, err)
+}
+
+func (s *elasticPostStore) Delete(ctx context.Context, id string) error {
+	return upstream(STORE_ELASTICSEARCH, deleteFromES(ctx, id))
+}
+
+func (s *elasticPostStore) GeoSearch(ctx context.Context, lat, lon float64, distance string, opts SearchOptions) (*PostPage, error) {
+	query := elastic.NewGeoDistanceQuery("location") // construct query
+	query = query.Distance(distance).Lat(lat).Lon(lon)
+	return esPage(readFromES(ctx, query, opts, esSorters(opts.Sort, lat, lon)...))
+}
+
+func (s *elasticPostStore) BoxSearch(ctx context.Context, box BoundingBox, opts SearchOptions) (*PostPage, error) {
+	query := elastic.NewGeoBoundingBoxQuery("location").
+		TopLeft(box.Top, box.Left).
+		BottomRight(box.Bottom, box.Right)
+	return esPage(readFromES(ctx, query, opts, esSorters(opts.Sort, 0, 0)...))
+}
+
+func (s *elasticPostStore) PolygonSearch(ctx context.Context, ring []Location, opts SearchOptions) (*PostPage, error) {
+	query := elastic.NewGeoPolygonQuery("location")
+	for _, loc := range ring {
+		query = query.AddPoint(loc.Lat, loc.Lon)
+	}
+	return esPage(readFromES(ctx, query, opts, esSorters(opts.Sort, 0, 0)...))
+}
+
+func (s *elasticPostStore) RangeSearch(ctx context.Context, field string, gte float64, opts SearchOptions) (*PostPage, error) {
+	query := elastic.NewRangeQuery(field).Gte(gte) // Gte() indicates a greater-than-or-equal value for the from part
+	return esPage(readFromES(ctx, query, opts, esSorters(opts.Sort, 0, 0)...))
+}
+
+func (s *elasticPostStore) TagSearch(ctx context.Context, tag string, opts SearchOptions) (*PostPage, error) {
+	query := elastic.NewTermQuery("tags", tag) // tags is a keyword field
+	return esPage(readFromES(ctx, query, opts, esSorters(opts.Sort, 0, 0)...))
+}
+
+func (s *elasticPostStore) Heatmap(ctx context.Context, box BoundingBox, precision int, filter HeatmapFilter) ([]HeatCell, error) {
+	cells, err := heatmapFromES(ctx, box, precision, filter)
+	return cells, upstream(STORE_ELASTICSEARCH, err)
+}
+
+// esPage marks the error of a readFromES call as ErrUpstream
+func esPage(page *PostPage, err error) (*PostPage, error) {
+	return page, upstream(STORE_ELASTICSEARCH, err)
+}
+
+// esSorters turns a sort option into Elasticsearch sorts, the id keyword breaks ties so search_after never skips posts.
+// It is doc_values, sorting on _id would load fielddata for every document into the heap.
+func esSorters(sort string, lat, lon float64) []elastic.Sorter {
+	var primary elastic.Sorter
+	switch sort {
+	case SORT_DISTANCE:
+		primary = elastic.NewGeoDistanceSort("location").Point(lat, lon).Unit("km").Asc()
+	case SORT_NEWEST:
+		primary = elastic.NewFieldSort("created_at").Desc().Missing(0) // posts from before created_at sort as 1970, not Long.MIN_VALUE
+	case SORT_RELEVANCE:
+		primary = elastic.NewScoreSort().Desc()
+	default: // SORT_FACE
+		primary = elastic.NewFieldSort("face").Desc()
+	}
+	return []elastic.Sorter{primary, elastic.NewFieldSort("id").Asc()}
+}
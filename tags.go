@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var hashtagPattern = regexp.MustCompile(`#([\p{L}\p{N}_]+)`) // #word, unicode letters allowed
+
+// extractTags returns the hashtags of a message, lowercased, without '#' and without duplicates
+func extractTags(message string) []string {
+	var tags []string
+	seen := map[string]bool{}
+	for _, match := range hashtagPattern.FindAllStringSubmatch(message, -1) {
+		tag := strings.ToLower(match[1])
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// normalizeTag accepts a tag from a url with or without '#'
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(tag, "#"))
+}
+
+func handlerTags(w http.ResponseWriter, r *http.Request) {
+	logFor(r.Context()).Debug("Received one tag request")
+	w.Header().Set("Content-Type", "application/json")
+
+	tag := normalizeTag(mux.Vars(r)["tag"])
+	if tag == "" {
+		writeError(w, r, invalidField("tag", "tag is required"), "Invalid request")
+		return
+	}
+	opts, err := parseSearchOptions(r, SORT_NEWEST, SORT_NEWEST, SORT_FACE)
+	if err != nil {
+		writeError(w, r, err, "Invalid request")
+		return
+	}
+
+	page, err := postStore.TagSearch(r.Context(), tag, opts)
+	if err != nil {
+		writeError(w, r, err, "Failed to read post")
+		return
+	}
+
+	writePostPage(w, r, page)
+}
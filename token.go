@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pborman/uuid"
+)
+
+// TokenResponse is returned by /login and /token/refresh
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"` // seconds until the access token expires
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// issueTokens signs a short lived access token and stores a new refresh token in family
+func issueTokens(ctx context.Context, username, family string) (*TokenResponse, error) {
+	now := time.Now()
+	// signed with the current key of the ring, which stamps its kid in the header
+	accessToken, err := keyRing.Sign(jwt.MapClaims{
+		"username": username,
+		"jti":      uuid.New(), // lets /logout revoke this token
+		"iat":      now.Unix(),
+		"exp":      now.Add(config.AccessTokenTTL).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 32) // opaque random refresh token
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	refreshToken := base64.RawURLEncoding.EncodeToString(buf)
+	err = tokenStore.SaveRefresh(ctx, hashToken(refreshToken), RefreshToken{
+		Username:  username,
+		Family:    family,
+		ExpiresAt: now.Add(config.RefreshTokenTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(config.AccessTokenTTL / time.Second),
+	}, nil
+}
+
+// hashToken is how refresh tokens are keyed in the store, a leaked store does not leak usable tokens
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// notRevoked rejects access tokens revoked by /logout, it runs after jwtMiddleware has validated the token
+func notRevoked(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := r.Context().Value("user").(*jwt.Token)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		claims, _ := token.Claims.(jwt.MapClaims)
+		username, _ := claims["username"].(string)
+		logUser(r, username)
+
+		jti, _ := claims["jti"].(string)
+		if jti == "" {
+			writeError(w, r, ErrUnauthorized, "Token has no id, please login again")
+			return
+		}
+		revoked, err := tokenStore.IsAccessRevoked(r.Context(), jti)
+		if err != nil {
+			writeError(w, r, err, "Failed to check token")
+			return
+		}
+		if revoked {
+			writeError(w, r, ErrUnauthorized, "Token has been revoked")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handlerRefresh(w http.ResponseWriter, r *http.Request) {
+	logFor(r.Context()).Debug("Received one token refresh request")
+	w.Header().Set("Content-Type", "application/json")
+
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		writeError(w, r, invalidField("refresh_token", "refresh_token is required"), "Cannot decode refresh token from client")
+		return
+	}
+
+	old, err := tokenStore.UseRefresh(r.Context(), hashToken(req.RefreshToken))
+	if err != nil {
+		if errors.Is(err, errTokenNotFound) {
+			writeError(w, r, ErrUnauthorized, "Invalid refresh token")
+		} else {
+			writeError(w, r, err, "Failed to read refresh token")
+		}
+		return
+	}
+	logUser(r, old.Username)
+	if old.Used { // rotated tokens are single use, a replay means the family is compromised
+		if err := tokenStore.RevokeFamily(r.Context(), old.Family); err != nil {
+			logFor(r.Context()).Error("Failed to revoke refresh token family", "error", err)
+		}
+		writeError(w, r, ErrUnauthorized, "Refresh token has already been used")
+		return
+	}
+	if time.Now().After(old.ExpiresAt) {
+		writeError(w, r, ErrUnauthorized, "Refresh token has expired")
+		return
+	}
+
+	resp, err := issueTokens(r.Context(), old.Username, old.Family)
+	if err != nil {
+		writeError(w, r, err, "Failed to generate token")
+		return
+	}
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, r, err, "Failed to parse token into JSON format")
+		return
+	}
+	w.Write(js)
+}
+
+func handlerLogout(w http.ResponseWriter, r *http.Request) {
+	logFor(r.Context()).Debug("Received one logout request")
+	w.Header().Set("Content-Type", "text/plain")
+
+	claims := r.Context().Value("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	username, _ := claims["username"].(string)
+	jti, _ := claims["jti"].(string)
+	exp, _ := claims["exp"].(float64)
+
+	if jti != "" {
+		if err := tokenStore.RevokeAccess(r.Context(), jti, time.Unix(int64(exp), 0)); err != nil {
+			writeError(w, r, err, "Failed to revoke token")
+			return
+		}
+	}
+
+	// the refresh token is optional, without it only this access token is killed
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err == nil && req.RefreshToken != "" {
+		hash := hashToken(req.RefreshToken)
+		old, err := tokenStore.GetRefresh(r.Context(), hash) // not used yet, someone else's token must stay valid
+		if err == nil && old.Username == username {
+			if _, err := tokenStore.UseRefresh(r.Context(), hash); err != nil {
+				writeError(w, r, err, "Failed to revoke refresh token")
+				return
+			}
+			if err := tokenStore.RevokeFamily(r.Context(), old.Family); err != nil {
+				writeError(w, r, err, "Failed to revoke refresh token")
+				return
+			}
+		} else if err != nil && !errors.Is(err, errTokenNotFound) {
+			writeError(w, r, err, "Failed to read refresh token")
+			return
+		}
+	}
+
+	logFor(r.Context()).Info("Logout", "user", username)
+	w.Write([]byte("Logged out successfully."))
+}
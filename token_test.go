@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+func TestMemoryTokenStoreUseRefresh(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryTokenStore()
+	expires := time.Now().Add(time.Hour)
+	store.SaveRefresh(ctx, "a", RefreshToken{Username: "alice", Family: "f1", ExpiresAt: expires})
+	store.SaveRefresh(ctx, "b", RefreshToken{Username: "alice", Family: "f1", ExpiresAt: expires})
+	store.SaveRefresh(ctx, "c", RefreshToken{Username: "alice", Family: "f2", ExpiresAt: expires})
+
+	if _, err := store.UseRefresh(ctx, "missing"); err != errTokenNotFound {
+		t.Fatalf("missing token: err = %v, want errTokenNotFound", err)
+	}
+	first, err := store.UseRefresh(ctx, "a")
+	if err != nil || first.Used {
+		t.Fatalf("first use = %+v, %v, want unused", first, err)
+	}
+	replay, err := store.UseRefresh(ctx, "a")
+	if err != nil || !replay.Used {
+		t.Fatalf("replay = %+v, %v, want used", replay, err)
+	}
+
+	if err := store.RevokeFamily(ctx, "f1"); err != nil {
+		t.Fatal(err)
+	}
+	for hash, used := range map[string]bool{"b": true, "c": false} {
+		token, err := store.UseRefresh(ctx, hash)
+		if err != nil || token.Used != used {
+			t.Errorf("token %s after revoking f1 = %+v, %v, want used %v", hash, token, err, used)
+		}
+	}
+}
+
+// refresh posts token to handlerRefresh and returns the status and the new tokens
+func refresh(t *testing.T, token string) (int, TokenResponse) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handlerRefresh(w, httptest.NewRequest("POST", "/token/refresh", strings.NewReader(`{"refresh_token":"`+token+`"}`)))
+	var resp TokenResponse
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, resp
+}
+
+func TestHandlerRefreshReplay(t *testing.T) {
+	setupMemory(t)
+	login, err := issueTokens(context.Background(), "alice", "family")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, rotated := refresh(t, login.RefreshToken)
+	if status != http.StatusOK || rotated.RefreshToken == "" || rotated.RefreshToken == login.RefreshToken {
+		t.Fatalf("first refresh = %d %+v, want a new token pair", status, rotated)
+	}
+	if status, _ := refresh(t, login.RefreshToken); status != http.StatusUnauthorized {
+		t.Fatalf("replayed refresh = %d, want 401", status)
+	}
+	// the replay revoked the family, so the token the legitimate client holds is dead too
+	if status, _ := refresh(t, rotated.RefreshToken); status != http.StatusUnauthorized {
+		t.Errorf("refresh after replay = %d, want 401", status)
+	}
+	if status, _ := refresh(t, "unknown"); status != http.StatusUnauthorized {
+		t.Errorf("unknown refresh token = %d, want 401", status)
+	}
+}
+
+func TestHandlerRefreshExpired(t *testing.T) {
+	setupMemory(t)
+	config.RefreshTokenTTL = -time.Minute
+	login, err := issueTokens(context.Background(), "alice", "family")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := refresh(t, login.RefreshToken); status != http.StatusUnauthorized {
+		t.Errorf("expired refresh token = %d, want 401", status)
+	}
+}
+
+func TestHandlerLogout(t *testing.T) {
+	setupMemory(t)
+	alice, err := issueTokens(context.Background(), "alice", "alice-family")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := issueTokens(context.Background(), "bob", "bob-family")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logout := func(refreshToken string) {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/logout", strings.NewReader(`{"refresh_token":"`+refreshToken+`"}`))
+		w := httptest.NewRecorder()
+		handlerLogout(w, asUser(r, "alice"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("logout = %d: %s", w.Code, w.Body)
+		}
+	}
+
+	logout(bob.RefreshToken) // not hers, must not burn it
+	if status, _ := refresh(t, bob.RefreshToken); status != http.StatusOK {
+		t.Errorf("bob's refresh after alice logged out with it = %d, want 200", status)
+	}
+	logout(alice.RefreshToken)
+	if status, _ := refresh(t, alice.RefreshToken); status != http.StatusUnauthorized {
+		t.Errorf("refresh after logout = %d, want 401", status)
+	}
+}
+
+func TestElasticTokenStoreRevokeFamily(t *testing.T) {
+	setupMemory(t)
+	// a family far past one search page, e.g. a session refreshed every 15 minutes for a month
+	tokens := make(map[string]RefreshToken)
+	for i := 0; i < 3000; i++ {
+		tokens[fmt.Sprintf("f1-%d", i)] = RefreshToken{Username: "alice", Family: "f1"}
+	}
+	tokens["f2-0"] = RefreshToken{Username: "bob", Family: "f2"}
+
+	// answers _update_by_query like Elasticsearch would for a term query on family
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+TOKEN_INDEX+"/_update_by_query" || r.URL.Query().Get("conflicts") != "proceed" {
+			http.Error(w, `{"error":"unexpected request"}`, http.StatusBadRequest)
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			return
+		}
+		var body struct {
+			Query struct {
+				Term struct {
+					Family string `json:"family"`
+				} `json:"term"`
+			} `json:"query"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		updated := 0
+		for id, token := range tokens {
+			if token.Family == body.Query.Term.Family {
+				token.Used = true
+				tokens[id] = token
+				updated++
+			}
+		}
+		fmt.Fprintf(w, `{"total":%d,"updated":%d}`, updated, updated)
+	}))
+	defer server.Close()
+
+	client, err := elastic.NewClient(elastic.SetURL(server.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldClient := esClient
+	esClient = client
+	defer func() { esClient = oldClient }()
+
+	if err := (&elasticTokenStore{}).RevokeFamily(context.Background(), "f1"); err != nil {
+		t.Fatal(err)
+	}
+	for id, token := range tokens {
+		if token.Used != (token.Family == "f1") {
+			t.Fatalf("token %s = %+v after revoking f1", id, token)
+		}
+	}
+}
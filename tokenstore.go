@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+const (
+	TOKEN_INDEX   = "token" // refresh tokens, keyed by sha256 of the token
+	TOKEN_TYPE    = "token"
+	REVOKED_INDEX = "revoked" // revoked access token ids (jti)
+	REVOKED_TYPE  = "revoked"
+
+	TOKEN_PURGE_INTERVAL = time.Hour // how often expired refresh tokens and revocations are deleted from Elasticsearch
+)
+
+var errTokenNotFound = errors.New("Token not found")
+
+// RefreshToken is the server side record of a refresh token, the token itself is never stored
+type RefreshToken struct {
+	Username  string    `json:"username"`
+	Family    string    `json:"family"` // all tokens rotated from the same login share a family
+	ExpiresAt time.Time `json:"expires_at"`
+	Used      bool      `json:"used"` // already exchanged, presenting it again means it was stolen
+}
+
+// TokenStore keeps refresh tokens and the access token revocation list
+type TokenStore interface {
+	EnsureSchema(ctx context.Context) error
+	SaveRefresh(ctx context.Context, hash string, token RefreshToken) error
+	GetRefresh(ctx context.Context, hash string) (RefreshToken, error) // reads the token without using it, errTokenNotFound if missing
+	UseRefresh(ctx context.Context, hash string) (RefreshToken, error) // marks the token used and returns it as it was before, errTokenNotFound if missing
+	RevokeFamily(ctx context.Context, family string) error             // marks every token of the family used
+	RevokeAccess(ctx context.Context, jti string, until time.Time) error
+	IsAccessRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+var tokenStore TokenStore // selected at startup in main
+
+// newTokenStore picks the backend by name
+func newTokenStore(backend string) (TokenStore, error) {
+	switch backend {
+	case STORE_ELASTICSEARCH:
+		return &elasticTokenStore{}, nil
+	case STORE_MEMORY:
+		return newMemoryTokenStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown token store %q", backend)
+	}
+}
+
+// memoryTokenStore only works for a single instance, tokens are lost on restart
+type memoryTokenStore struct {
+	mu      sync.Mutex
+	refresh map[string]RefreshToken // hash -> token
+	revoked map[string]time.Time    // jti -> until
+}
+
+func newMemoryTokenStore() *memoryTokenStore {
+	return &memoryTokenStore{
+		refresh: make(map[string]RefreshToken),
+		revoked: make(map[string]time.Time),
+	}
+}
+
+func (s *memoryTokenStore) EnsureSchema(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryTokenStore) SaveRefresh(ctx context.Context, hash string, token RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	s.refresh[hash] = token
+	return nil
+}
+
+func (s *memoryTokenStore) GetRefresh(ctx context.Context, hash string) (RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.refresh[hash]
+	if !ok {
+		return RefreshToken{}, errTokenNotFound
+	}
+	return token, nil
+}
+
+func (s *memoryTokenStore) UseRefresh(ctx context.Context, hash string) (RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.refresh[hash]
+	if !ok {
+		return RefreshToken{}, errTokenNotFound
+	}
+	used := token
+	used.Used = true
+	s.refresh[hash] = used
+	return token, nil
+}
+
+func (s *memoryTokenStore) RevokeFamily(ctx context.Context, family string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, token := range s.refresh {
+		if token.Family == family {
+			token.Used = true
+			s.refresh[hash] = token
+		}
+	}
+	return nil
+}
+
+func (s *memoryTokenStore) RevokeAccess(ctx context.Context, jti string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	s.revoked[jti] = until
+	return nil
+}
+
+func (s *memoryTokenStore) IsAccessRevoked(ctx context.Context, jti string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.revoked[jti]
+	return ok, nil
+}
+
+// expire drops records that can no longer matter, caller holds the lock
+func (s *memoryTokenStore) expire() {
+	now := time.Now()
+	for hash, token := range s.refresh {
+		if now.After(token.ExpiresAt) {
+			delete(s.refresh, hash)
+		}
+	}
+	for jti, until := range s.revoked {
+		if now.After(until) {
+			delete(s.revoked, jti)
+		}
+	}
+}
+
+// elasticTokenStore shares tokens between instances through Elasticsearch
+type elasticTokenStore struct {
+	mu        sync.Mutex
+	lastPurge time.Time
+}
+
+func (s *elasticTokenStore) EnsureSchema(ctx context.Context) error {
+	indices := map[string]string{
+		TOKEN_INDEX: `{
+            "mappings": {
+                "token": {
+                    "properties": {
+                        "username":   {"type": "keyword"},
+                        "family":     {"type": "keyword"},
+                        "expires_at": {"type": "date"},
+                        "used":       {"type": "boolean"}
+                    }
+                }
+            }
+        }`,
+		REVOKED_INDEX: `{
+            "mappings": {
+                "revoked": {
+                    "properties": {
+                        "until": {"type": "date"}
+                    }
+                }
+            }
+        }`,
+	}
+	for index, mapping := range indices {
+		exists, err := esClient.IndexExists(index).Do(ctx)
+		if err != nil {
+			return upstream(STORE_ELASTICSEARCH, err)
+		}
+		if !exists {
+			if _, err := esClient.CreateIndex(index).Body(mapping).Do(ctx); err != nil {
+				return upstream(STORE_ELASTICSEARCH, err)
+			}
+		}
+	}
+	return s.purge(ctx)
+}
+
+// purge deletes expired refresh tokens and revocations, like memoryTokenStore.expire. It runs at startup and
+// then at most every TOKEN_PURGE_INTERVAL on writes, in the background on the Elasticsearch side.
+func (s *elasticTokenStore) purge(ctx context.Context) error {
+	s.mu.Lock()
+	if time.Since(s.lastPurge) < TOKEN_PURGE_INTERVAL {
+		s.mu.Unlock()
+		return nil
+	}
+	s.lastPurge = time.Now()
+	s.mu.Unlock()
+
+	for index, field := range map[string]string{TOKEN_INDEX: "expires_at", REVOKED_INDEX: "until"} {
+		_, err := esClient.DeleteByQuery(index).
+			Query(elastic.NewRangeQuery(field).Lt("now")).
+			ProceedOnVersionConflict(). // a token used meanwhile is purged next time
+			WaitForCompletion(false).
+			Do(ctx)
+		if err != nil {
+			return upstream(STORE_ELASTICSEARCH, err)
+		}
+	}
+	return nil
+}
+
+func (s *elasticTokenStore) SaveRefresh(ctx context.Context, hash string, token RefreshToken) error {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+
+	if err := s.purge(ctx); err != nil {
+		logFor(ctx).Warn("Cannot purge expired tokens", "error", err)
+	}
+
+	_, err := esClient.Index().
+		Index(TOKEN_INDEX).
+		Type(TOKEN_TYPE).
+		Id(hash).
+		BodyJson(token).
+		Refresh("wait_for").
+		Do(ctx)
+	return upstream(STORE_ELASTICSEARCH, err)
+}
+
+// getRefresh reads a token along with the document version UseRefresh updates it against
+func (s *elasticTokenStore) getRefresh(ctx context.Context, hash string) (RefreshToken, *elastic.GetResult, error) {
+	result, err := esClient.Get().
+		Index(TOKEN_INDEX).
+		Type(TOKEN_TYPE).
+		Id(hash).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return RefreshToken{}, nil, errTokenNotFound
+	}
+	if err != nil {
+		return RefreshToken{}, nil, upstream(STORE_ELASTICSEARCH, err)
+	}
+	if !result.Found || result.Source == nil {
+		return RefreshToken{}, nil, errTokenNotFound
+	}
+
+	var token RefreshToken
+	if err := json.Unmarshal(*result.Source, &token); err != nil {
+		return RefreshToken{}, nil, upstream(STORE_ELASTICSEARCH, err)
+	}
+	return token, result, nil
+}
+
+func (s *elasticTokenStore) GetRefresh(ctx context.Context, hash string) (RefreshToken, error) {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+
+	token, _, err := s.getRefresh(ctx, hash)
+	return token, err
+}
+
+func (s *elasticTokenStore) UseRefresh(ctx context.Context, hash string) (RefreshToken, error) {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+
+	token, result, err := s.getRefresh(ctx, hash)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if token.Used {
+		return token, nil
+	}
+	if result.SeqNo == nil || result.PrimaryTerm == nil {
+		return RefreshToken{}, upstream(STORE_ELASTICSEARCH, errors.New("get returned no _seq_no, elasticsearch 6.7 or later is required"))
+	}
+	_, err = esClient.Update().
+		Index(TOKEN_INDEX).
+		Type(TOKEN_TYPE).
+		Id(hash).
+		Doc(map[string]interface{}{"used": true}).
+		IfSeqNo(*result.SeqNo). // only if nobody marked it since the get
+		IfPrimaryTerm(*result.PrimaryTerm).
+		Refresh("wait_for").
+		Do(ctx)
+	if elastic.IsConflict(err) { // a concurrent request exchanged the same token, one of them is a replay
+		token.Used = true
+		return token, nil
+	}
+	if err != nil {
+		return RefreshToken{}, upstream(STORE_ELASTICSEARCH, err)
+	}
+	return token, nil
+}
+
+func (s *elasticTokenStore) RevokeFamily(ctx context.Context, family string) error {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+
+	// one request for the whole family however long it grew, a search would only see its first page
+	_, err := esClient.UpdateByQuery(TOKEN_INDEX).
+		Query(elastic.NewTermQuery("family", family)).
+		Script(elastic.NewScript("ctx._source.used = true")).
+		ProceedOnVersionConflict(). // a token used meanwhile is used already
+		Refresh("true").            // the next refresh with a token of the family must see it used
+		Do(ctx)
+	if err != nil {
+		return upstream(STORE_ELASTICSEARCH, err)
+	}
+	logFor(ctx).Info("Refresh token family is revoked", "family", family)
+	return nil
+}
+
+func (s *elasticTokenStore) RevokeAccess(ctx context.Context, jti string, until time.Time) error {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+
+	if err := s.purge(ctx); err != nil {
+		logFor(ctx).Warn("Cannot purge expired tokens", "error", err)
+	}
+
+	_, err := esClient.Index().
+		Index(REVOKED_INDEX).
+		Type(REVOKED_TYPE).
+		Id(jti).
+		BodyJson(map[string]interface{}{"until": until}).
+		Refresh("wait_for").
+		Do(ctx)
+	return upstream(STORE_ELASTICSEARCH, err)
+}
+
+func (s *elasticTokenStore) IsAccessRevoked(ctx context.Context, jti string) (bool, error) {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+
+	result, err := esClient.Get().
+		Index(REVOKED_INDEX).
+		Type(REVOKED_TYPE).
+		Id(jti).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, upstream(STORE_ELASTICSEARCH, err)
+	}
+	return result.Found, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	SERVICE_NAME        = "around"
+	TRACE_FLUSH_TIMEOUT = 5 * time.Second // spans still buffered at shutdown get this long to reach the collector
+)
+
+var tracer = otel.Tracer(SERVICE_NAME) // follows the provider set by setupTracing, a no-op until then
+
+var shutdownTracing = func(ctx context.Context) error { return nil } // flushes the exporter, set by setupTracing
+
+// setupTracing accepts and sends W3C traceparent headers, and exports spans over OTLP/HTTP when otlp_endpoint is set.
+// Without an endpoint spans are not recorded, but incoming trace ids are still passed on to the backends.
+func setupTracing(ctx context.Context) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if config.OTLPEndpoint == "" {
+		return nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.OTLPEndpoint)}
+	if config.OTLPInsecure {
+		opts = append(opts, otlptracehttp.WithInsecure()) // plain http, e.g. a collector on localhost:4318
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", SERVICE_NAME),
+			attribute.String("service.version", version),
+		)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.TraceSampleRatio))), // callers that already sampled win
+	)
+	otel.SetTracerProvider(provider)
+	shutdownTracing = provider.Shutdown
+	return nil
+}
+
+// startSpan starts a child span of whatever ctx carries, end it with endSpan
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan marks span failed if err is set, ends it and passes err through
+func endSpan(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	return err
+}
+
+// injectTrace adds traceparent to an outgoing request so the callee joins the trace
+func injectTrace(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
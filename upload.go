@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	UPLOAD_MEMORY = 10 << 20 // multipart parts beyond this are buffered in temp files, not memory
+	SNIFF_LEN     = 512      // bytes read to detect the content type, as http.DetectContentType
+)
+
+// mediaType is an accepted upload extension, the kind stored in Post.Type and the content types its bytes may have
+type mediaType struct {
+	kind  string // image or video
+	mimes []string
+}
+
+var mediaTypes = map[string]mediaType{ // lowercase extension -> what the file must contain
+	".jpeg": {"image", []string{"image/jpeg"}},
+	".jpg":  {"image", []string{"image/jpeg"}},
+	".gif":  {"image", []string{"image/gif"}},
+	".png":  {"image", []string{"image/png"}},
+	".mov":  {"video", []string{"video/quicktime", "video/mp4"}}, // newer QuickTime files are ISO media like mp4
+	".mp4":  {"video", []string{"video/mp4"}},
+	".avi":  {"video", []string{"video/avi"}},
+	".flv":  {"video", []string{"video/x-flv"}},
+	".wmv":  {"video", []string{"video/x-ms-wmv"}},
+}
+
+// video signatures http.DetectContentType does not know
+var (
+	flvMagic = []byte("FLV\x01")
+	asfMagic = []byte{0x30, 0x26, 0xB2, 0x75, 0x8E, 0x66, 0xCF, 0x11} // ASF header object, the container of wmv
+)
+
+// sniffMediaType detects the content type of a file from its first bytes
+func sniffMediaType(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, flvMagic):
+		return "video/x-flv"
+	case bytes.HasPrefix(head, asfMagic):
+		return "video/x-ms-wmv"
+	case len(head) >= 12 && string(head[4:8]) == "ftyp" && string(head[8:12]) == "qt  ":
+		return "video/quicktime"
+	case len(head) >= 8 && (string(head[4:8]) == "moov" || string(head[4:8]) == "mdat" || string(head[4:8]) == "wide"):
+		return "video/quicktime" // QuickTime from before ftyp
+	}
+	mime := http.DetectContentType(head)
+	if i := strings.Index(mime, ";"); i >= 0 {
+		mime = mime[:i] // text/plain; charset=utf-8
+	}
+	return mime
+}
+
+// checkUpload reads the start of file and returns its media type, kind and content type if the content is one
+// the extension of filename allows. file is rewound for the caller.
+func checkUpload(file multipart.File, filename string) (mediaType, string, error) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	mt, ok := mediaTypes[ext]
+	if !ok {
+		return mediaType{}, "", fmt.Errorf("%w: extension %q", ErrUnsupportedMedia, ext)
+	}
+
+	head := make([]byte, SNIFF_LEN)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF { // short files are fine
+		return mediaType{}, "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return mediaType{}, "", err
+	}
+
+	mime := sniffMediaType(head[:n])
+	for _, allowed := range mt.mimes {
+		if mime == allowed {
+			return mt, mime, nil
+		}
+	}
+	return mediaType{}, "", fmt.Errorf("%w: %s content in a %s file", ErrUnsupportedMedia, mime, ext)
+}
+
+// parseUpload parses the multipart body of r, at most max_upload_size bytes of it
+func parseUpload(w http.ResponseWriter, r *http.Request) error {
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxUploadSize)
+	err := r.ParseMultipartForm(UPLOAD_MEMORY)
+	var tooLarge *http.MaxBytesError
+	if err != nil && !errors.As(err, &tooLarge) {
+		return invalidField("body", "cannot parse multipart form: %v", err)
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// memFile is an in-memory multipart.File
+type memFile struct {
+	*bytes.Reader
+}
+
+func (memFile) Close() error { return nil }
+
+func TestCheckUpload(t *testing.T) {
+	jpeg := append([]byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x10}, "JFIF\x00"...)
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	gif := []byte("GIF89a\x01\x00\x01\x00")
+	mp4 := []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom")
+	mov := []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00qt  ")
+	oldMov := []byte("\x00\x00\x00\x08wide\x00\x00\x00\x00mdat")
+	flv := []byte("FLV\x01\x05\x00\x00\x00\x09")
+	wmv := []byte{0x30, 0x26, 0xB2, 0x75, 0x8E, 0x66, 0xCF, 0x11, 0xA6, 0xD9, 0x00, 0xAA}
+	html := []byte("<html><script>alert(1)</script></html>")
+
+	tests := []struct {
+		name     string
+		filename string
+		content  []byte
+		kind     string // empty if rejected
+		mime     string
+	}{
+		{"jpeg", "a.jpeg", jpeg, "image", "image/jpeg"},
+		{"jpg upper case", "a.JPG", jpeg, "image", "image/jpeg"},
+		{"png", "a.png", png, "image", "image/png"},
+		{"gif", "a.gif", gif, "image", "image/gif"},
+		{"mp4", "a.mp4", mp4, "video", "video/mp4"},
+		{"mp4 in mov", "a.mov", mp4, "video", "video/mp4"},
+		{"quicktime", "a.mov", mov, "video", "video/quicktime"},
+		{"quicktime without ftyp", "a.mov", oldMov, "video", "video/quicktime"},
+		{"flv", "a.flv", flv, "video", "video/x-flv"},
+		{"wmv", "a.wmv", wmv, "video", "video/x-ms-wmv"},
+		{"png named jpg", "a.jpg", png, "", ""},
+		{"html named png", "a.png", html, "", ""},
+		{"mov named mp4", "a.mp4", mov, "", ""},
+		{"empty", "a.jpg", nil, "", ""},
+		{"unknown extension", "a.exe", jpeg, "", ""},
+		{"no extension", "jpg", jpeg, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := memFile{bytes.NewReader(tt.content)}
+			mt, mime, err := checkUpload(file, tt.filename)
+			if tt.kind == "" {
+				if !errors.Is(err, ErrUnsupportedMedia) {
+					t.Errorf("err = %v, want ErrUnsupportedMedia", err)
+				}
+				return
+			}
+			if err != nil || mt.kind != tt.kind || mime != tt.mime {
+				t.Fatalf("checkUpload = %v, %q, %v, want %s %s", mt.kind, mime, err, tt.kind, tt.mime)
+			}
+			rest, _ := io.ReadAll(file)
+			if !bytes.Equal(rest, tt.content) {
+				t.Error("file is not rewound")
+			}
+		})
+	}
+}
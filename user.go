@@ -4,15 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
-	"reflect"
 	"regexp"
-	"time"
 
-	jwt "github.com/dgrijalva/jwt-go"
-	//"github.com/olivere/elastic"
-	elastic "gopkg.in/olivere/elastic.v6"
+	"github.com/pborman/uuid"
 )
 
 const (
@@ -22,150 +17,155 @@ const (
 
 type User struct {
 	Username string `json:"username"`
-	Password string `json:"password"`
+	Password string `json:"password"` // bcrypt hash in the index, plain only in signup/login requests
 	Age      int64  `json:"age"`
 	Gender   string `json:"gender"`
 }
 
-var mySigningKey = []byte("secret") // private key
-
-func checkUser(username, password string) error { // check whether valid
-	client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false)) // connect
-	if err != nil {
-		return err
+func checkUser(ctx context.Context, username, password string) error { // check whether valid
+	u, err := userStore.Get(ctx, username)
+	if errors.Is(err, errUserNotFound) {
+		burnPassword(password) // as slow as a wrong password
+		return ErrBadCredentials
 	}
-	// get user
-	query := elastic.NewTermQuery("username", username) // make query
-
-	searchResult, err := client.Search().
-		Index(USER_INDEX). // search in USER_INDEX
-		Query(query). // where username = ...
-		Pretty(true).
-		Do(context.Background())
 	if err != nil {
 		return err
 	}
-	// compare, if same log in
-	var utyp User
-	for _, item := range searchResult.Each(reflect.TypeOf(utyp)) { // 从searchResult导出所有结果并转换为User存入utyp
-		if u, ok := item.(User); ok { // utyp中的每一个转换为User赋值给u
-			if username == u.Username && password == u.Password {
-				fmt.Printf("Login as %s\n", username)
-				return nil
-			}
+	ok, rehash := verifyPassword(u.Password, password)
+	if !ok {
+		return ErrBadCredentials
+	}
+	if rehash { // plaintext or weaker hash, replace it now that we know the password
+		if err := updatePassword(ctx, u, password); err != nil {
+			logFor(ctx).Warn("Failed to upgrade password hash", "user", username, "error", err)
 		}
 	}
-
-	return errors.New("Wrong username or password") // 创建error消息
+	logFor(ctx).Info("Login", "user", username)
+	return nil
 }
 
-func addUser(user User) error { // sign up
-	client, err := elastic.NewClient(elastic.SetURL(ES_URL), elastic.SetSniff(false)) // connect to es
+func addUser(ctx context.Context, user User) error { // sign up
+	// never store the plain password
+	hash, err := hashPassword(user.Password)
 	if err != nil {
 		return err
 	}
+	user.Password = hash
+	if err := userStore.Create(ctx, user); err != nil { // ErrUserExists if the username is taken
+		return err
+	}
+
+	logFor(ctx).Info("User is added", "user", user.Username)
+	return nil
+}
 
-	// select * from users where username = ?
-	query := elastic.NewTermQuery("username", user.Username) // username = ...
-	// find user name in users
-	searchResult, err := client.Search().
-		Index(USER_INDEX).
-		Query(query).
-		Pretty(true).
-		Do(context.Background()) // select * from users where username = ?
+// updatePassword rewrites the user record with a freshly hashed password
+func updatePassword(ctx context.Context, user User, password string) error {
+	hash, err := hashPassword(password)
 	if err != nil {
 		return err
 	}
-	// if exist
-	if searchResult.TotalHits() > 0 { // TotalHits is a convenience function to return the number of hits for a search result
-		return errors.New("User already exists")
-	}
-	// add user
-	_, err = client.Index().
-		Index(USER_INDEX).
-		Type(USER_TYPE).
-		Id(user.Username).
-		BodyJson(user).
-		Refresh("wait_for"). // Wait for the changes made by the request to be made visible by a refresh before replying
-		Do(context.Background())
-	if err != nil {
+	user.Password = hash
+	if err := userStore.Update(ctx, user); err != nil {
 		return err
 	}
 
-	fmt.Printf("User is added: %s\n", user.Username)
+	logFor(ctx).Info("Password hash is upgraded", "user", user.Username)
 	return nil
 }
 
 func handlerLogin(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Received one login request")
-	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	logFor(r.Context()).Debug("Received one login request")
+	w.Header().Set("Content-Type", "application/json")
 
-	if r.Method == "OPTIONS" {
+	ip := remoteIP(r)
+	if err := checkRate(r.Context(), "login:ip:"+ip, loginIPRate); err != nil {
+		writeError(w, r, err, "Too many login attempts, try again later")
 		return
 	}
 
 	decoder := json.NewDecoder(r.Body) // get request body and get user
 	var user User
 	if err := decoder.Decode(&user); err != nil { // 判断request中是否存在username，若存在保存进user
-		http.Error(w, "Cannot decode user data from client", http.StatusBadRequest)
-		fmt.Printf("Cannot decode user data from client %v.\n", err)
+		writeError(w, r, invalidField("body", "cannot decode user data: %v", err), "Cannot decode user data from client")
+		return
+	}
+	logUser(r, user.Username) // failed logins too, that is who the access log is for
+	// per username and IP like the lockout, so other clients cannot use up the bucket of a user. The global bucket
+	// is far larger, an attacker has to send that many logins to block the user.
+	if err := checkRate(r.Context(), lockoutKey(user.Username, ip), loginUserRate); err != nil {
+		writeError(w, r, err, "Too many login attempts, try again later")
+		return
+	}
+	if err := checkRate(r.Context(), "login:user:"+user.Username, loginUserGlobalRate); err != nil {
+		writeError(w, r, err, "Too many login attempts, try again later")
+		return
+	}
+	if err := checkLockout(r.Context(), user.Username, ip); err != nil {
+		writeError(w, r, err, "Too many failed logins, try again later")
 		return
 	}
 	// check user if exist and match
-	if err := checkUser(user.Username, user.Password); err != nil { // 若error非空，判断error类型
-		if err.Error() == "Wrong username or password" {
-			http.Error(w, "Wrong username or password", http.StatusUnauthorized)
+	if err := checkUser(r.Context(), user.Username, user.Password); err != nil { // ErrBadCredentials is a 401, the rest is the backend
+		if errors.Is(err, ErrBadCredentials) {
+			loginFailed(r.Context(), user.Username, ip)
+			writeError(w, r, err, "Wrong username or password")
 		} else {
-			http.Error(w, "Failed to read from ElasticSearch", http.StatusInternalServerError)
+			writeError(w, r, err, "Failed to read from ElasticSearch")
 		}
 		return
 	}
-	// Create a new token object, specifying signing method and the claims you would like it to contain.
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": user.Username,
-		"exp":      time.Now().Add(time.Hour * 24).Unix(),
-	})
-	// send token to client
-	// Sign and get the complete encoded token as a string using the secret(the private key)
-	tokenString, err := token.SignedString(mySigningKey)
+	loginSucceeded(r.Context(), user.Username, ip)
+	// send access and refresh token to client, every login starts a new refresh token family
+	resp, err := issueTokens(r.Context(), user.Username, uuid.New())
 	if err != nil {
-		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
-		fmt.Printf("Failed to generate token %v.\n", err)
+		writeError(w, r, err, "Failed to generate token")
 		return
 	}
 
-	w.Write([]byte(tokenString))
+	js, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, r, err, "Failed to parse token into JSON format")
+		return
+	}
+	w.Write(js)
 }
 
 func handlerSignup(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Received one signup request")
+	logFor(r.Context()).Debug("Received one signup request")
 	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	if r.Method == "OPTIONS" {
+	if err := checkRate(r.Context(), "signup:ip:"+remoteIP(r), signupIPRate); err != nil { // every signup is a document in USER_INDEX
+		writeError(w, r, err, "Too many signups, try again later")
 		return
 	}
 
 	decoder := json.NewDecoder(r.Body) // 取出信息
 	var user User
 	if err := decoder.Decode(&user); err != nil { // 提取user
-		http.Error(w, "Cannot decode user data from client", http.StatusBadRequest)
-		fmt.Printf("Cannot decode user data from client %v.\n", err)
+		writeError(w, r, invalidField("body", "cannot decode user data: %v", err), "Cannot decode user data from client")
 		return
 	}
 	// user name sanity check
-	if user.Username == "" || user.Password == "" || !regexp.MustCompile(`^[a-z0-9_]+$`).MatchString(user.Username) {
-		http.Error(w, "Invalid username or password", http.StatusBadRequest)
-		fmt.Printf("Invalid username or password.\n")
+	if user.Username == "" || !regexp.MustCompile(`^[a-z0-9_]+$`).MatchString(user.Username) {
+		writeError(w, r, invalidField("username", "username must be lowercase letters, digits or _"), "Invalid username or password")
+		return
+	}
+	if user.Password == "" {
+		writeError(w, r, invalidField("password", "password is required"), "Invalid username or password")
+		return
+	}
+	if len(user.Password) > BCRYPT_MAX_PASSWORD {
+		writeError(w, r, invalidField("password", "password must be at most %d bytes", BCRYPT_MAX_PASSWORD), "Invalid username or password")
 		return
 	}
+	logUser(r, user.Username)
 	// add user
-	if err := addUser(user); err != nil { // 非空判断错误类型
-		if err.Error() == "User already exists" {
-			http.Error(w, "User already exists", http.StatusBadRequest)
+	if err := addUser(r.Context(), user); err != nil { // 非空判断错误类型
+		if errors.Is(err, ErrUserExists) {
+			writeError(w, r, err, "User already exists")
 		} else {
-			http.Error(w, "Failed to save to ElasticSearch", http.StatusInternalServerError)
+			writeError(w, r, err, "Failed to save to ElasticSearch")
 		}
 		return
 	}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerSignupLogin(t *testing.T) {
+	setupMemory(t)
+	userStore.Create(context.Background(), User{Username: "legacy", Password: "plain"}) // saved before passwords were hashed
+
+	post := func(handler http.HandlerFunc, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		return w
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		path    string
+		body    string
+		status  int
+	}{
+		{"signup", handlerSignup, "/signup", `{"username":"alice","password":"secret"}`, http.StatusOK},
+		{"signup taken", handlerSignup, "/signup", `{"username":"alice","password":"other"}`, http.StatusConflict},
+		{"signup bad name", handlerSignup, "/signup", `{"username":"Alice!","password":"secret"}`, http.StatusBadRequest},
+		{"login", handlerLogin, "/login", `{"username":"alice","password":"secret"}`, http.StatusOK},
+		{"login wrong password", handlerLogin, "/login", `{"username":"alice","password":"guess"}`, http.StatusUnauthorized},
+		{"login unknown user", handlerLogin, "/login", `{"username":"nobody","password":"secret"}`, http.StatusUnauthorized},
+		{"login legacy", handlerLogin, "/login", `{"username":"legacy","password":"plain"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := post(tt.handler, tt.path, tt.body); w.Code != tt.status {
+				t.Errorf("%s = %d, want %d: %s", tt.path, w.Code, tt.status, w.Body)
+			}
+		})
+	}
+
+	alice, err := userStore.Get(context.Background(), "alice")
+	if err != nil || !isPasswordHash(alice.Password) {
+		t.Errorf("stored alice = %+v, %v, want a password hash", alice, err)
+	}
+	legacy, err := userStore.Get(context.Background(), "legacy")
+	if err != nil || !isPasswordHash(legacy.Password) {
+		t.Errorf("legacy after login = %+v, %v, want the password rehashed", legacy, err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	elastic "gopkg.in/olivere/elastic.v6"
+)
+
+var errUserNotFound = fmt.Errorf("User %w", ErrNotFound)
+
+// UserStore keeps accounts, Password is always a hash here except in legacy records
+type UserStore interface {
+	EnsureSchema(ctx context.Context) error
+	Get(ctx context.Context, username string) (User, error) // errUserNotFound if missing
+	Create(ctx context.Context, user User) error            // ErrUserExists if the username is taken
+	Update(ctx context.Context, user User) error            // replaces the record of user.Username
+}
+
+var userStore UserStore // selected at startup in main
+
+// newUserStore picks the backend by name
+func newUserStore(backend string) (UserStore, error) {
+	switch backend {
+	case STORE_ELASTICSEARCH:
+		return &elasticUserStore{}, nil
+	case STORE_MEMORY:
+		return newMemoryUserStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown user store %q", backend)
+	}
+}
+
+// memoryUserStore only works for a single instance, accounts are lost on restart
+type memoryUserStore struct {
+	mu    sync.Mutex
+	users map[string]User // username -> user
+}
+
+func newMemoryUserStore() *memoryUserStore {
+	return &memoryUserStore{users: make(map[string]User)}
+}
+
+func (s *memoryUserStore) EnsureSchema(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryUserStore) Get(ctx context.Context, username string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[username]
+	if !ok {
+		return User{}, errUserNotFound
+	}
+	return user, nil
+}
+
+func (s *memoryUserStore) Create(ctx context.Context, user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[user.Username]; ok {
+		return ErrUserExists
+	}
+	s.users[user.Username] = user
+	return nil
+}
+
+func (s *memoryUserStore) Update(ctx context.Context, user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users[user.Username] = user
+	return nil
+}
+
+// elasticUserStore keeps users in USER_INDEX, one document per username.
+// Every error except errUserNotFound and ErrUserExists comes back marked as ErrUpstream.
+type elasticUserStore struct{}
+
+func (s *elasticUserStore) EnsureSchema(ctx context.Context) error {
+	return upstream(STORE_ELASTICSEARCH, ensureIndex(ctx, esClient, USER_INDEX))
+}
+
+func (s *elasticUserStore) Get(ctx context.Context, username string) (User, error) {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+
+	// a get by id is real-time, a search could miss a user who just signed up
+	result, err := esClient.Get().
+		Index(USER_INDEX).
+		Type(USER_TYPE).
+		Id(username).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return User{}, errUserNotFound
+	}
+	if err != nil {
+		return User{}, upstream(STORE_ELASTICSEARCH, err)
+	}
+	if !result.Found || result.Source == nil {
+		return User{}, errUserNotFound
+	}
+	var u User
+	if err := json.Unmarshal(*result.Source, &u); err != nil {
+		return User{}, upstream(STORE_ELASTICSEARCH, err)
+	}
+	return u, nil
+}
+
+func (s *elasticUserStore) Create(ctx context.Context, user User) error {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+
+	// op_type create fails if the id exists, so two signups for one name cannot overwrite each other
+	_, err := esClient.Index().
+		Index(USER_INDEX).
+		Type(USER_TYPE).
+		Id(user.Username).
+		OpType("create").
+		BodyJson(user).
+		Do(ctx)
+	if elastic.IsConflict(err) {
+		return ErrUserExists
+	}
+	return upstream(STORE_ELASTICSEARCH, err)
+}
+
+func (s *elasticUserStore) Update(ctx context.Context, user User) error {
+	ctx, cancel := storeContext(ctx)
+	defer cancel()
+
+	_, err := esClient.Index().
+		Index(USER_INDEX).
+		Type(USER_TYPE).
+		Id(user.Username).
+		BodyJson(user).
+		Do(ctx)
+	return upstream(STORE_ELASTICSEARCH, err)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	RANGE_UNIT_DEFAULT = "km" // a bare range like 10 is 10km, as /search always assumed
+)
+
+var rangeUnits = []string{"m", "km", "mi"} // units accepted in the range parameter, meters per unit are in distanceUnits
+
+// fieldError is a bad request parameter, writeError names the field so clients can point at it
+type fieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *fieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+func invalidField(field, format string, args ...interface{}) error {
+	return &fieldError{Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+// parseCoordinate reads a required number between min and max
+func parseCoordinate(field, val string, min, max float64) (float64, error) {
+	val = strings.TrimSpace(val)
+	if val == "" {
+		return 0, invalidField(field, "%s is required", field)
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, invalidField(field, "%s must be a number", field)
+	}
+	if !(f >= min && f <= max) { // NaN fails every comparison, so it must be tested this way round
+		return 0, invalidField(field, "%s must be between %g and %g", field, min, max)
+	}
+	return f, nil
+}
+
+// parseLatLon reads the lat and lon parameters with get, e.g. r.FormValue or r.URL.Query().Get
+func parseLatLon(get func(string) string) (Location, error) {
+	lat, err := parseCoordinate("lat", get("lat"), -90, 90)
+	if err != nil {
+		return Location{}, err
+	}
+	lon, err := parseCoordinate("lon", get("lon"), -180, 180)
+	if err != nil {
+		return Location{}, err
+	}
+	return Location{Lat: lat, Lon: lon}, nil
+}
+
+// checkLocation applies the range checks of parseLatLon to a location from a JSON body
+func checkLocation(field string, loc Location) error {
+	if !(loc.Lat >= -90 && loc.Lat <= 90) || !(loc.Lon >= -180 && loc.Lon <= 180) {
+		return invalidField(field, "%s must be within -90..90, -180..180", field)
+	}
+	return nil
+}
+
+// parseRange reads a search radius like 10, 500m, 10km or 3mi and returns it as an Elasticsearch distance in meters.
+// Empty means search_distance, anything over max_search_distance is rejected rather than silently shrunk.
+func parseRange(val string) (string, error) {
+	val = strings.TrimSpace(val)
+	if val == "" {
+		return config.SearchDistance, nil // checked by Config.validate
+	}
+	i := len(val)
+	for i > 0 && !strings.ContainsAny(val[i-1:i], "0123456789.") {
+		i--
+	}
+	unit := strings.TrimSpace(val[i:])
+	if unit == "" {
+		unit = RANGE_UNIT_DEFAULT
+	}
+	known := false
+	for _, u := range rangeUnits {
+		known = known || u == unit
+	}
+	if !known {
+		return "", invalidField("range", "range unit must be one of %s", strings.Join(rangeUnits, ", "))
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(val[:i]), 64)
+	if err != nil || !(value > 0) {
+		return "", invalidField("range", "range must be a positive number")
+	}
+
+	meters := value * distanceUnits[unit]
+	max, _ := parseDistance(config.MaxSearchDistance) // checked by Config.validate
+	if meters > max {
+		return "", invalidField("range", "range must be at most %s", config.MaxSearchDistance)
+	}
+	return strconv.FormatFloat(meters, 'f', -1, 64) + "m", nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+func TestParseCoordinate(t *testing.T) {
+	tests := []struct {
+		val  string
+		want float64
+		ok   bool
+	}{
+		{"37.5", 37.5, true},
+		{" -90 ", -90, true},
+		{"90", 90, true},
+		{"", 0, false},
+		{"north", 0, false},
+		{"90.0001", 0, false},
+		{"-91", 0, false},
+		{"NaN", 0, false},
+		{"nan", 0, false},
+		{"Inf", 0, false},
+		{"-Inf", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseCoordinate("lat", tt.val, -90, 90)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseCoordinate(%q) = %v, %v, want %v ok %v", tt.val, got, err, tt.want, tt.ok)
+		}
+		if err != nil {
+			if fe, isField := err.(*fieldError); !isField || fe.Field != "lat" {
+				t.Errorf("parseCoordinate(%q) error %v does not name lat", tt.val, err)
+			}
+		}
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	setupMemory(t) // default search_distance 200km, max_search_distance 1000km
+
+	tests := []struct {
+		val  string
+		want string
+		ok   bool
+	}{
+		{"", "200km", true},
+		{"10", "10000m", true},
+		{"500m", "500m", true},
+		{"2.5km", "2500m", true},
+		{"3mi", "4828.032m", true},
+		{" 1 km ", "1000m", true},
+		{"1000km", "1000000m", true},
+		{"1001km", "", false},
+		{"0", "", false},
+		{"-5km", "", false},
+		{"10ft", "", false},
+		{"km", "", false},
+		{"NaNkm", "", false},
+		{"1e400", "", false},
+	}
+	for _, tt := range tests {
+		got, err := parseRange(tt.val)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseRange(%q) = %q, %v, want %q ok %v", tt.val, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCheckLocation(t *testing.T) {
+	tests := []struct {
+		loc Location
+		ok  bool
+	}{
+		{Location{Lat: 0, Lon: 0}, true},
+		{Location{Lat: -90, Lon: 180}, true},
+		{Location{Lat: 90.5, Lon: 0}, false},
+		{Location{Lat: 0, Lon: -180.5}, false},
+	}
+	for _, tt := range tests {
+		if err := checkLocation("location", tt.loc); (err == nil) != tt.ok {
+			t.Errorf("checkLocation(%+v) = %v, want ok %v", tt.loc, err, tt.ok)
+		}
+	}
+}